@@ -5,84 +5,244 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"github.com/ad-freiburg/gtfs-shp-eval/shpeval"
 	"github.com/patrickbr/gtfsparser"
-	gtfs "github.com/patrickbr/gtfsparser/gtfs"
 	flag "github.com/spf13/pflag"
-	"math"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var DEG_TO_RAD float64 = 0.017453292519943295769236907684886127134428718885417254560
-var SHP_CACHE map[*gtfs.Shape][][]float64
+// parses a list of route_type=distance pairs like "3=250,1=60"
+func parseMaxDistByType(s string) (map[int16]float64, error) {
+	ret := make(map[int16]float64)
 
-func latLngToWebMerc(lat float32, lng float32) (float64, float64) {
-	x := 6378137.0 * lng * float32(DEG_TO_RAD)
-	a := float64(lat * float32(DEG_TO_RAD))
+	if len(strings.TrimSpace(s)) == 0 {
+		return ret, nil
+	}
 
-	lng = x
-	lat = float32(3189068.5 * math.Log((1.0+math.Sin(a))/(1.0-math.Sin(a))))
-	return float64(lng), float64(lat)
-}
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid entry '%s', expected <route_type>=<distance>", entry)
+		}
+
+		t, err := strconv.ParseInt(strings.TrimSpace(kv[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route type '%s'", kv[0])
+		}
 
-func perpDist(px, py, lax, lay, lbx, lby float64) float64 {
-	d := dist(lax, lay, lbx, lby) * dist(lax, lay, lbx, lby)
+		d, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid distance '%s'", kv[1])
+		}
 
-	if d == 0 {
-		return dist(px, py, lax, lay)
-	}
-	t := float64((px-lax)*(lbx-lax)+(py-lay)*(lby-lay)) / d
-	if t < 0 {
-		return dist(px, py, lax, lay)
-	} else if t > 1 {
-		return dist(px, py, lbx, lby)
+		ret[int16(t)] = d
 	}
 
-	return dist(px, py, lax+t*(lbx-lax), lay+t*(lby-lay))
+	return ret, nil
 }
 
-func dist(x1 float64, y1 float64, x2 float64, y2 float64) float64 {
-	return math.Sqrt(float64((x2-x1)*(x2-x1) + (y2-y1)*(y2-y1)))
-}
+// parses a comma-separated list of strictly increasing histogram bucket bounds
+func parseHistogramBuckets(s string) ([]float64, error) {
+	ret := make([]float64, 0)
 
-func check_shape(trip *gtfs.Trip, feed *gtfsparser.Feed, maxDist float64) bool {
-	shp := trip.Shape
+	for _, entry := range strings.Split(s, ",") {
+		d, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid bucket bound '%s'", entry)
+		}
+		if len(ret) > 0 && d <= ret[len(ret)-1] {
+			return nil, fmt.Errorf("bucket bounds must be increasing, got '%s' after %g", entry, ret[len(ret)-1])
+		}
+		ret = append(ret, d)
+	}
 
-	if _, ok := SHP_CACHE[shp]; !ok {
-		for _, p := range shp.Points {
-			x, y := latLngToWebMerc(p.Lat, p.Lon)
-			SHP_CACHE[shp] = append(SHP_CACHE[shp], []float64{x, y})
+	return ret, nil
+}
+
+// writes the rows separated by tabs, tabs and line breaks in values are
+// replaced by spaces as there is no quoting
+func writeTsv(w io.Writer, rows [][]string) {
+	repl := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	for _, row := range rows {
+		vals := make([]string, len(row))
+		for i, v := range row {
+			vals[i] = repl.Replace(v)
 		}
+		fmt.Fprintln(w, strings.Join(vals, "\t"))
 	}
+}
 
-	for _, s := range trip.StopTimes {
-		x, y := latLngToWebMerc(s.Stop.Lat, s.Stop.Lon)
+// reads a CSV file with a stop_id and a weight column
+func readStopWeights(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		pepdist := math.Inf(1)
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	recs, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("'%s' is empty", path)
+	}
 
-		for i := 1; i < len(SHP_CACHE[shp]); i++ {
-			curdist := perpDist(x, y, SHP_CACHE[shp][i-1][0], SHP_CACHE[shp][i-1][1], SHP_CACHE[shp][i][0], SHP_CACHE[shp][i][1])
-			if curdist < pepdist {
-				pepdist = curdist
-			}
+	idCol, weightCol := -1, -1
+	for i, h := range recs[0] {
+		switch strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")) {
+		case "stop_id":
+			idCol = i
+		case "weight":
+			weightCol = i
 		}
+	}
+	if idCol < 0 || weightCol < 0 {
+		return nil, fmt.Errorf("'%s' needs a stop_id and a weight column", path)
+	}
 
-		if pepdist*math.Cos(float64(s.Stop.Lat)*DEG_TO_RAD) > maxDist {
-			return false
+	ret := make(map[string]float64)
+	for i, rec := range recs[1:] {
+		if idCol >= len(rec) || weightCol >= len(rec) {
+			return nil, fmt.Errorf("line %d of '%s' has too few columns", i+2, path)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(rec[weightCol]), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight '%s' in line %d of '%s'", rec[weightCol], i+2, path)
 		}
+		ret[strings.TrimSpace(rec[idCol])] = w
 	}
 
-	return true
+	return ret, nil
+}
+
+// exit codes besides 0 and 1 for errors, 2 is used by the flag parser for
+// invalid options
+var EXIT_FAIL_UNDER int = 3
+var EXIT_DEADLINE int = 4
+var EXIT_NO_TRIPS int = 5
+
+// number of worst suspicious trips listed in each feed report
+var REPORT_WORST_TRIPS int = 10
+
+// a colored score is yellow up to this many percentage points above
+// --fail-under, without --fail-under red and yellow below these scores
+var COLOR_YELLOW_MARGIN float64 = 5
+var COLOR_RED_UNDER float64 = 50
+var COLOR_YELLOW_UNDER float64 = 90
+
+// true if w is a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "gtfs-shp-eval - (C) 2020 University of Freiburg, Chair of Algorithms and Data Structures\n\nAnalyze shape.txt quality and coverage of GTFS feeds.\n\nUsage:\n\n  %s [<options>] <folder containing input GTFS feeds>*\n\nAllowed options:\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "gtfs-shp-eval - (C) 2020 University of Freiburg, Chair of Algorithms and Data Structures\n\nAnalyze shape.txt quality and coverage of GTFS feeds.\n\nUsage:\n\n  %s [<options>] <folder containing input GTFS feeds or feed URL>*\n\nAllowed options:\n\n", os.Args[0])
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit codes:\n\n  0  success\n  1  error, e.g. an unreadable feed or output file\n  2  invalid options\n  %d  the score is below --fail-under\n  %d  the --deadline was exceeded\n  %d  no trips were analyzed, or --list-feeds found no feeds\n", EXIT_FAIL_UNDER, EXIT_DEADLINE, EXIT_NO_TRIPS)
 	}
 
-	maxDist := flag.Float64P("max-dist", "d", 250, "max distance from station to shape")
+	maxDist := flag.Float64P("max-dist", "d", 250, "max distance from station to shape, in meters regardless of --units")
+	warnDist := flag.Float64("warn-dist", 0, "count trips whose worst stop is farther than this many meters from the shape, but still within the max distance, as borderline instead of OK, 0 to disable")
+	maxDistByTypeStr := flag.String("max-dist-by-type", "", "comma-separated <route_type>=<meters> pairs overriding --max-dist per GTFS route_type, e.g. '3=250,1=60,4=500'. Route types: 0 tram, 1 subway, 2 rail, 3 bus, 4 ferry, 5 cable tram, 6 aerial lift, 7 funicular, 11 trolleybus, 12 monorail, extended types (100-1700) are matched exactly")
+	distMode := flag.String("distance-mode", "webmerc", "distance computation, either 'webmerc' (web mercator with latitude correction), 'haversine' (great-circle distance), 'utm' (planar distance in the UTM zone of each feed, haversine for feeds spanning several zones) or 'enu' (stop-to-shape distances in the plane tangent to the earth at each stop, web mercator otherwise)")
+	units := flag.String("units", "m", "unit of the distances in --csv, --geojson and --verbose output, either 'm', 'km' or 'ft'. Options and the summary always use meters")
+	csvPath := flag.String("csv", "", "write per-stop distances of all trips with a shape to this CSV file")
+	geojsonPath := flag.String("geojson", "", "write shapes and too distant stops of suspicious trips to this GeoJSON file")
+	epsilon := flag.Float64("epsilon", 0.5, "coordinates at most this many meters apart are the same when counting distinct and duplicate shape points (--dedup-points) and comparing shapes (--find-dup-shapes)")
+	hashPrec := flag.Int("hash-precision", 6, "decimal places coordinates are rounded to before shapes are hashed for --find-dup-shapes and --global-shape-cache. Too coarse merges distinct shapes, which then share their projection in the cache (--find-dup-shapes still compares them within --epsilon), too fine misses true duplicates whose coordinates differ in the last digits. 6 decimals are about 0.1 m")
+	collinearTol := flag.Float64("deg-tolerance", 1, "shapes with at least 3 distinct points that all lie within this many meters of one of their trip's stops, i.e. straight placeholder lines from stop to stop, are degenerate (collinear)")
+	minLenRatio := flag.Float64("deg-min-length-ratio", 0.5, "shapes shorter than this fraction of the diagonal of their trip's stop bounding box are degenerate")
+	autoDist := flag.Bool("auto-dist", false, "derive the max distance of each feed from its own stop-to-shape distances, see --auto-dist-percentile and --auto-dist-margin. Replaces --max-dist")
+	autoDistPct := flag.Float64("auto-dist-percentile", 95, "percentile of the stop-to-shape distances used by --auto-dist")
+	autoDistMargin := flag.Float64("auto-dist-margin", 25, "meters added to the percentile by --auto-dist")
+	maxBearingDiff := flag.Float64("max-bearing-diff", 0, "count trips where the direction between two consecutive stops differs by more than this many degrees from the shape's direction at both stops, 0 to disable")
+	minLengthRatio := flag.Float64("min-length-ratio", 0, "flag trips whose shape is shorter than this fraction of the median shape length of the trips of their route type in the feed as suspiciously short, 0 to disable")
+	stopWeightsPath := flag.String("stop-weights", "", "CSV file with a stop_id and a weight column, e.g. boardings per stop. Reports the summed weight of the stops beyond the max distance of suspicious trips as their impact, stops not listed weigh 0")
+	placeholderRatio := flag.Float64("placeholder-ratio", 0, "flag trips whose stops snap to less than this many distinct positions along the shape per stop (positions within --epsilon are the same) as placeholder shapes, 0 to disable")
+	maxDistFrac := flag.Float64("max-dist-frac", 0, "derive the max distance of each stop as this fraction of its mean distance to the neighboring stops, so that widely spaced stops get a larger tolerance. --max-dist (or --max-dist-by-type, --auto-dist) is the minimum, --max-dist-frac-cap the maximum. 0 to disable")
+	maxDistFracCap := flag.Float64("max-dist-frac-cap", 1000, "max distance in meters derived with --max-dist-frac at most")
+	maxTail := flag.Float64("max-tail", 0, "flag trips whose shape runs more than this many meters before their first or after their last stop, e.g. a depot access leg, as having a spurious tail, 0 to disable")
+	maxOutsideBBox := flag.Float64("max-outside-bbox", 0, "flag trips with more than this fraction (0 to 1) of their shape points outside the bounding box of their stops expanded by --max-dist, as the shape probably belongs to another trip, 0 to disable")
+	maxDetour := flag.Float64("max-detour", 0, "flag trips whose shape is more than this many times longer than the direct distance between their first and last stop, 0 to disable")
+	maxDensity := flag.Float64("max-density", 0, "report shapes with more than this many points per km of shape length as over-dense, 0 to disable")
+	minDensity := flag.Float64("min-density", 0, "shapes with less than this many points per km of shape length are under-dense and their trips degenerate, 0 to disable")
+	shapeLen := flag.Bool("shape-length", false, "report the total length of distinct shape geometry per feed and in total")
+	selfInters := flag.Bool("self-intersect", false, "count shapes with crossings of non-adjacent segments, list them with --verbose. Legitimately looping routes are counted as well")
+	routes := flag.StringArray("route", nil, "only evaluate trips of the route with this route_id, with verbose output. Repeatable, combined with --trip")
+	tripIds := flag.StringArray("trip", nil, "only evaluate the trip with this trip_id, with verbose output. Repeatable, combined with --route")
+	includeGlobs := flag.StringArray("include-glob", nil, "only evaluate feeds found in the given folders whose name matches this pattern, e.g. '*.zip'. Patterns containing a / are matched against the whole path. Repeatable, a feed must match any of them")
+	excludeGlobs := flag.StringArray("exclude-glob", nil, "skip feeds and folders found in the given folders whose name matches this pattern, e.g. '*_draft*'. Patterns containing a / are matched against the whole path. Repeatable")
+	coverage := flag.Bool("coverage", false, "report the distribution of the fraction of each trip's shape length that lies within the max distance of one of its stops, to find shapes extending beyond their route")
+	orphanStops := flag.Bool("orphan-stops", false, "count stops farther than --max-dist (or the --max-dist-by-type of the shape's trips) from every shape used by any trip, list them with --verbose")
+	simplify := flag.Float64("simplify", 0, "report how many shape points Douglas-Peucker simplification with this tolerance in meters could drop while keeping all stops within --max-dist, 0 to disable. Feeds are not modified")
+	writeGtfs := flag.String("write-gtfs", "", "write each feed with deduplicated (--dedup-points) and simplified (--simplify) shapes into a subdirectory of this directory, shapes are only simplified if no OK trip becomes non-OK")
+	worstStopsPath := flag.String("worst-stops-per-feed", "", "write the --top N stops of each feed farthest from the shape of any trip serving them to this CSV file, e.g. as a deduplicated list of locations to fix")
+	top := flag.Int("top", 0, "report the N trips with the most distant stops across all feeds, regardless of their class, 0 to disable")
+	checkDistTraveled := flag.Bool("check-dist-traveled", false, "count shapes and trips whose shape_dist_traveled decreases and stop times whose shape_dist_traveled lies outside of their shape's range, list them with --verbose")
+	minStopSim := flag.Float64("min-stop-similarity", 0, "flag trips sharing a shape whose set of stops has a Jaccard similarity below this to that of the shape's most common stop pattern, as at least one of them probably uses the wrong shape, list them with --verbose. 0 to disable")
+	findDupShapes := flag.Bool("find-dup-shapes", false, "count shapes with the same geometry as another shape of their feed and the points they waste, list them with --verbose")
+	stats := flag.Bool("stats", false, "report percentiles of all stop-to-shape distances and of the shape points per stop of each trip")
+	histogram := flag.Bool("histogram", false, "print a histogram of all stop-to-shape distances")
+	histogramBucketsStr := flag.String("histogram-buckets", "25,50,100,250,500,1000", "comma-separated upper bounds of the --histogram buckets, in meters")
+	noSortShapes := flag.Bool("no-sort-shapes", false, "do not sort shape points by shape_pt_sequence before evaluation")
+	dedupPoints := flag.Bool("dedup-points", false, "remove consecutive shape points within --epsilon of each other before evaluation")
+	ignoreNonStop := flag.Bool("ignore-nonstop", false, "ignore stop times where neither boarding nor alighting is possible (pickup_type=1 and drop_off_type=1)")
+	offsets := flag.Bool("offsets", false, "split the stop-to-shape distances into offsets across the nearest shape segment, e.g. a shape on the wrong street, and along it beyond its ends, e.g. a truncated shape, and report both distributions")
+	bbox := flag.Bool("bbox", false, "report the bounding box and centroid of the stops and shape points of each feed, e.g. to spot garbage coordinates")
+	minStops := flag.Int("min-stops", 0, "leave trips with less than this many stop times, often deadheads or special entries, out of the evaluation, 0 to disable")
+	skipNullCoords := flag.Bool("skip-null-coords", false, "leave stops at 0,0 or with NaN coordinates out of the evaluation, trips without any other stop are not evaluated at all")
+	weightBySvc := flag.Bool("weight-by-service", false, "additionally report trip percentages weighted by the number of departures of each trip")
+	timeout := flag.Duration("timeout", 5*time.Minute, "timeout for downloading feeds given as http(s) URLs")
+	dropErroneous := flag.Bool("drop-erroneous", true, "drop erroneous entities (and entities depending on them) while parsing instead of failing the feed")
+	useDefOnError := flag.Bool("use-default-on-error", true, "use the default value of optional fields with erroneous values while parsing instead of treating the entity as erroneous")
+	zipFix := flag.Bool("zip-fix", true, "try to read ZIP files with broken central directories or nested folders")
+	checkNullCoords := flag.Bool("check-null-coordinates", false, "treat stops and shape points at 0,0 as erroneous")
+	byRouteType := flag.Bool("by-route-type", false, "break down trip counts per GTFS route_type")
+	byAgency := flag.Bool("by-agency", false, "break down trip counts per agency")
+	failUnder := flag.Float64("fail-under", 0, "exit with code 3 if the score, the percentage of OK or borderline trips among the trips selected by --ok-basis (by default those with a shape), is below this value")
+	requireShapes := flag.Bool("require-shapes", false, "count trips without a shape as errors, the score is then the percentage of all trips that have an OK shape. Same as --ok-basis all")
+	okBasis := flag.String("ok-basis", "shaped", "trips the score is the percentage of OK trips of, either 'all' (trips without a shape count as errors), 'shaped' (trips with a shape) or 'nondegenerate' (trips with a shape that is not degenerated)")
+	jobs := flag.IntP("jobs", "j", runtime.NumCPU(), "number of feeds to parse and evaluate in parallel")
+	lowMemory := flag.Bool("low-memory", false, "evaluate the trips of each feed grouped by shape and drop the projections of a shape after its last trip instead of keeping all of them, trading recomputation for a smaller peak memory use. The peak number of cached shapes is reported with --timings and --verbose")
+	maxInflight := flag.Int("max-inflight", runtime.NumCPU(), "max number of feeds loaded into memory at the same time. Lower than --jobs, it caps the memory used for large feeds while the remaining workers only serve feeds from the --cache")
+	color := flag.String("color", "auto", "colorize the OK percentage and the score of the text summary against --fail-under and the number of suspicious trips, either 'auto' (only if the summary is written to a terminal and NO_COLOR is not set), 'always' or 'never'")
+	format := flag.String("format", "text", "summary output format, either 'text', 'json' or 'tsv'. 'tsv' prints the per-stop distances of --csv separated by tabs and without quoting instead of the summary, e.g. for pasting into spreadsheets")
+	outPath := flag.String("out", "", "write the summary to this file instead of stdout, the file is created or truncated")
+	jsonl := flag.Bool("jsonl", false, "stream one JSON object per trip (feed, trip_id, class, worst_distance) to stdout as evaluation proceeds, the summary and all logs then go to stderr")
+	feedsFrom := flag.String("feeds-from", "", "read feed paths or URLs from this file, one per line, in addition to the positional arguments. Listed feeds are not searched for further feeds")
+	sample := flag.Float64("sample", 1, "evaluate only this random fraction of trips and extrapolate the trip counts, e.g. 0.1 for a quick estimate")
+	seed := flag.Int64("seed", 1, "seed of the random trip selection of --sample")
+	reportDir := flag.String("report-dir", "", "additionally write a JSON report per feed into this directory, existing reports are overwritten")
+	globalCache := flag.Bool("global-shape-cache", false, "share projected shapes between feeds by their coordinates, e.g. for regional slices of a national feed")
+	globalCacheSize := flag.Int("global-shape-cache-size", 10000, "max number of shapes kept in the --global-shape-cache")
+	listFeeds := flag.Bool("list-feeds", false, "only print the feed paths and URLs that would be evaluated, one per line, and exit without parsing. Exits with code 5 if none were found")
+	deadline := flag.Duration("deadline", 0, "stop after this duration, print the summary of the feeds evaluated so far and exit with code 4, 0 to disable")
+	baseline := flag.String("baseline", "", "also evaluate this earlier version of the single feed given and report the trips, matched by trip_id, that are no longer OK or borderline and those that became so, and the change of the score")
+	cachePath := flag.String("cache", "", "keep the results of each feed in this file and reuse them for feeds that were not modified since and are evaluated with the same options. URLs are always evaluated, so are all feeds with --verbose, as its per-trip lines are not cached")
+	timings := flag.Bool("timings", false, "report the parse and evaluation time of each feed and the total time")
+	quiet := flag.BoolP("quiet", "q", false, "do not print per-feed progress, only the summary and errors")
+	verbose := flag.BoolP("verbose", "v", false, "print each suspicious trip with its worst stop as it is found")
 	help := flag.BoolP("help", "?", false, "this message")
 
 	flag.Parse()
@@ -92,14 +252,238 @@ func main() {
 		return
 	}
 
+	if *distMode != "webmerc" && *distMode != "haversine" && *distMode != "utm" && *distMode != "enu" {
+		fmt.Fprintf(os.Stderr, "Unknown distance mode '%s', see --help\n", *distMode)
+		os.Exit(1)
+	}
+
+	maxDistByType, err := parseMaxDistByType(*maxDistByTypeStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --max-dist-by-type: %v\n", err)
+		os.Exit(1)
+	}
+
+	var histogramBuckets []float64
+	if *histogram {
+		if histogramBuckets, err = parseHistogramBuckets(*histogramBucketsStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --histogram-buckets: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *sample <= 0 || *sample > 1 {
+		fmt.Fprintln(os.Stderr, "--sample must be in (0, 1]")
+		os.Exit(1)
+	}
+
+	// both versions would be compared on different subsets of their trips
+	if *baseline != "" && *sample < 1 {
+		fmt.Fprintln(os.Stderr, "--baseline can not be combined with --sample")
+		os.Exit(1)
+	}
+
+	if *warnDist < 0 || (*warnDist > 0 && !*autoDist && *warnDist >= *maxDist) {
+		fmt.Fprintln(os.Stderr, "--warn-dist must be below --max-dist")
+		os.Exit(1)
+	}
+
+	if *autoDist && len(maxDistByType) > 0 {
+		fmt.Fprintln(os.Stderr, "--auto-dist can not be combined with --max-dist-by-type")
+		os.Exit(1)
+	}
+
+	if *autoDistPct <= 0 || *autoDistPct > 100 {
+		fmt.Fprintln(os.Stderr, "--auto-dist-percentile must be in (0, 100]")
+		os.Exit(1)
+	}
+
+	if *maxBearingDiff < 0 || *maxBearingDiff > 180 {
+		fmt.Fprintln(os.Stderr, "--max-bearing-diff must be in [0, 180]")
+		os.Exit(1)
+	}
+
+	if *placeholderRatio < 0 || *placeholderRatio > 1 {
+		fmt.Fprintln(os.Stderr, "--placeholder-ratio must be in [0, 1]")
+		os.Exit(1)
+	}
+
+	if *epsilon < 0 {
+		fmt.Fprintln(os.Stderr, "--epsilon must not be negative")
+		os.Exit(1)
+	}
+
+	if *minStopSim < 0 || *minStopSim > 1 {
+		fmt.Fprintln(os.Stderr, "--min-stop-similarity must be in [0, 1]")
+		os.Exit(1)
+	}
+
+	if *maxDistFrac < 0 {
+		fmt.Fprintln(os.Stderr, "--max-dist-frac must not be negative")
+		os.Exit(1)
+	}
+
+	if *maxTail < 0 {
+		fmt.Fprintln(os.Stderr, "--max-tail must not be negative")
+		os.Exit(1)
+	}
+
+	if *maxOutsideBBox < 0 || *maxOutsideBBox >= 1 {
+		fmt.Fprintln(os.Stderr, "--max-outside-bbox must be at least 0 and less than 1")
+		os.Exit(1)
+	}
+
+	if *minStops < 0 {
+		fmt.Fprintln(os.Stderr, "--min-stops must not be negative")
+		os.Exit(1)
+	}
+
+	if *hashPrec < 0 || *hashPrec > 9 {
+		fmt.Fprintln(os.Stderr, "--hash-precision must be in [0, 9]")
+		os.Exit(1)
+	}
+
+	if *okBasis != "all" && *okBasis != "shaped" && *okBasis != "nondegenerate" {
+		fmt.Fprintf(os.Stderr, "Unknown score basis '%s', see --help\n", *okBasis)
+		os.Exit(1)
+	}
+
+	if *requireShapes {
+		if flag.CommandLine.Changed("ok-basis") && *okBasis != "all" {
+			fmt.Fprintln(os.Stderr, "--require-shapes can only be combined with --ok-basis all")
+			os.Exit(1)
+		}
+		*okBasis = "all"
+	}
+
+	if *cachePath != "" && (*jsonl || *writeGtfs != "") {
+		fmt.Fprintln(os.Stderr, "--cache can not be combined with --jsonl or --write-gtfs")
+		os.Exit(1)
+	}
+
+	if *top < 0 {
+		fmt.Fprintln(os.Stderr, "--top must not be negative")
+		os.Exit(1)
+	}
+
+	if _, ok := shpeval.UNITS[*units]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown unit '%s', see --help\n", *units)
+		os.Exit(1)
+	}
+
+	if *format != "text" && *format != "json" && *format != "tsv" {
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s', see --help\n", *format)
+		os.Exit(1)
+	}
+
+	if *color != "auto" && *color != "always" && *color != "never" {
+		fmt.Fprintf(os.Stderr, "Unknown color mode '%s', see --help\n", *color)
+		os.Exit(1)
+	}
+
+	if *format == "tsv" && *jsonl && *outPath == "" {
+		fmt.Fprintln(os.Stderr, "--format tsv requires --out when combined with --jsonl")
+		os.Exit(1)
+	}
+
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	if *maxInflight < 1 {
+		fmt.Fprintln(os.Stderr, "--max-inflight must be at least 1")
+		os.Exit(1)
+	}
+
+	if *worstStopsPath != "" && *top <= 0 {
+		fmt.Fprintln(os.Stderr, "--worst-stops-per-feed requires --top N")
+		os.Exit(1)
+	}
+
+	var outF *os.File
+	var outW *bufio.Writer
+	if *outPath != "" {
+		var err error
+		if outF, err = os.Create(*outPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open summary output:", err)
+			os.Exit(1)
+		}
+		outW = bufio.NewWriter(outF)
+	}
+
+	// keep stdout clean for machine-readable output
+	logOut := &shpeval.SyncWriter{W: os.Stdout}
+	if ((*format == "json" || *format == "tsv") && outF == nil) || *jsonl {
+		logOut.W = os.Stderr
+	}
+
+	var sumOut io.Writer = os.Stdout
+	if outW != nil {
+		sumOut = outW
+	} else if *jsonl {
+		sumOut = os.Stderr
+	}
+
+	var progOut io.Writer = logOut
+	// progress indicator, always on stderr to keep a JSON summary on stdout clean
+	var progErr io.Writer = &shpeval.SyncWriter{W: os.Stderr}
+	if *quiet {
+		progOut = io.Discard
+		progErr = io.Discard
+	}
+
 	folders := flag.Args()
 	gtfsPaths := make([]string, 0)
 
+	var stopWeights map[string]float64
+	if *stopWeightsPath != "" {
+		var err error
+		if stopWeights, err = readStopWeights(*stopWeightsPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read stop weights:", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, g := range append(append([]string{}, *includeGlobs...), *excludeGlobs...) {
+		if _, err := filepath.Match(g, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid glob pattern '%s'\n", g)
+			os.Exit(1)
+		}
+	}
+
+	if *feedsFrom != "" {
+		listed, err := shpeval.ReadFeedList(*feedsFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not read feed list:", err)
+			os.Exit(1)
+		}
+		gtfsPaths = append(gtfsPaths, listed...)
+	}
+
 	for _, folder := range folders {
-		filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
-			gtfsPaths = append(gtfsPaths, path)
-			return nil
-		})
+		if folder == shpeval.STDIN_PATH {
+			if len(folders) > 1 || *feedsFrom != "" {
+				fmt.Fprintln(os.Stderr, "'-' reads a single zipped feed from stdin and can not be combined with other feeds")
+				os.Exit(1)
+			}
+			if *baseline == shpeval.STDIN_PATH {
+				fmt.Fprintln(os.Stderr, "The feed and --baseline can not both be read from stdin")
+				os.Exit(1)
+			}
+		}
+	}
+
+	gtfsPaths = append(gtfsPaths, shpeval.FindFeeds(folders, *includeGlobs, *excludeGlobs)...)
+	gtfsPaths = shpeval.UniqueFeeds(gtfsPaths)
+
+	if *listFeeds {
+		for _, p := range gtfsPaths {
+			fmt.Println(p)
+		}
+		fmt.Fprintf(os.Stderr, "%d feeds found\n", len(gtfsPaths))
+		if len(gtfsPaths) == 0 {
+			os.Exit(EXIT_NO_TRIPS)
+		}
+		os.Exit(0)
 	}
 
 	if len(gtfsPaths) == 0 {
@@ -107,59 +491,383 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *baseline != "" && len(gtfsPaths) != 1 {
+		fmt.Fprintf(os.Stderr, "--baseline requires exactly one feed to compare against, found %d\n", len(gtfsPaths))
+		os.Exit(1)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Fprintln(os.Stderr, "Error:", r)
 		}
 	}()
 
-	num_trips := 0
-	num_ok := 0
-	num_err := 0
-	num_deg := 0
-	num_no_shp := 0
-	num_feeds := 0
-	num_feeds_w_shps := 0
+	if *reportDir != "" {
+		if err := os.MkdirAll(*reportDir, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not create report directory:", err)
+			os.Exit(1)
+		}
+	}
+
+	var csvW *csv.Writer
+
+	// the default unit keeps the original header
+	distCol := "distance"
+	if *units != "m" {
+		distCol = "distance_" + *units
+	}
+	csvHeader := []string{"feed", "trip_id", "stop_id", "stop_sequence", distCol}
+
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open CSV output:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		csvW = csv.NewWriter(f)
+		csvW.Write(csvHeader)
+	}
+
+	if *format == "tsv" {
+		writeTsv(sumOut, [][]string{csvHeader})
+	}
+
+	var worstStopsW *csv.Writer
+
+	if *worstStopsPath != "" {
+		f, err := os.Create(*worstStopsPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open worst stops output:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		worstStopsW = csv.NewWriter(f)
+		worstStopsW.Write([]string{"feed", "stop_id", "stop_name", "stop_lat", "stop_lon", distCol, "trip_id"})
+	}
+
+	geojson := shpeval.GeoJsonFeatureCollection{Type: "FeatureCollection", Features: make([]shpeval.GeoJsonFeature, 0)}
+	var geojsonF *os.File
+
+	if *geojsonPath != "" {
+		f, err := os.Create(*geojsonPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open GeoJSON output:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		geojsonF = f
+	}
+
+	evalOpts := shpeval.Options{
+		MaxDist:           *maxDist,
+		MaxDistByType:     maxDistByType,
+		WarnDist:          *warnDist,
+		AutoDist:          *autoDist,
+		AutoDistPct:       *autoDistPct,
+		AutoDistMargin:    *autoDistMargin,
+		DistMode:          *distMode,
+		CollinearTol:      *collinearTol,
+		MinLenRatio:       *minLenRatio,
+		MaxDetour:         *maxDetour,
+		MaxTail:           *maxTail,
+		MaxOutsideBBox:    *maxOutsideBBox,
+		MaxDistFrac:       *maxDistFrac,
+		MaxDistFracCap:    *maxDistFracCap,
+		MinLengthRatio:    *minLengthRatio,
+		MaxBearingDiff:    *maxBearingDiff,
+		MaxDensity:        *maxDensity,
+		MinDensity:        *minDensity,
+		ShapeLength:       *shapeLen,
+		SelfIntersect:     *selfInters,
+		OrphanStops:       *orphanStops,
+		CheckDistTraveled: *checkDistTraveled,
+		PlaceholderRatio:  *placeholderRatio,
+		StopWeights:       stopWeights,
+		FindDupShapes:     *findDupShapes,
+		MinStopSimilarity: *minStopSim,
+		Epsilon:           *epsilon,
+		HashPrecision:     *hashPrec,
+		Coverage:          *coverage,
+		Offsets:           *offsets,
+		LowMemory:         *lowMemory,
+		Simplify:          *simplify,
+		WriteGtfs:         *writeGtfs,
+		Stats:             *stats,
+		Histogram:         histogramBuckets,
+		SortShapes:        !*noSortShapes,
+		DedupPoints:       *dedupPoints,
+		IgnoreNonStop:     *ignoreNonStop,
+		SkipNullCoords:    *skipNullCoords,
+		MinStops:          *minStops,
+		BBox:              *bbox,
+		RequireShapes:     *requireShapes,
+		OkBasis:           *okBasis,
+		Sample:            *sample,
+		Seed:              *seed,
+		WeightByService:   *weightBySvc,
+		Timeout:           *timeout,
+		ParseOpts: gtfsparser.ParseOptions{
+			UseDefValueOnError:   *useDefOnError,
+			DropErroneous:        *dropErroneous,
+			CheckNullCoordinates: *checkNullCoords,
+			EmptyStringRepl:      "",
+			ZipFix:               *zipFix,
+		},
+		Csv:      csvW != nil || *format == "tsv",
+		GeoJson:  geojsonF != nil,
+		Top:      *top,
+		Verbose:  *verbose,
+		Timings:  *timings,
+		Units:    *units,
+		Log:      logOut,
+		Progress: progErr,
+	}
+
+	if *jsonl {
+		evalOpts.Jsonl = &shpeval.SyncWriter{W: os.Stdout}
+	}
+
+	if len(*routes) > 0 || len(*tripIds) > 0 {
+		evalOpts.Routes = make(map[string]bool)
+		for _, r := range *routes {
+			evalOpts.Routes[r] = true
+		}
+		evalOpts.Trips = make(map[string]bool)
+		for _, t := range *tripIds {
+			evalOpts.Trips[t] = true
+		}
+		evalOpts.Verbose = true
+	}
+
+	if *reportDir != "" {
+		evalOpts.WorstTrips = REPORT_WORST_TRIPS
+	}
+
+	if *worstStopsPath != "" {
+		evalOpts.WorstStops = *top
+	}
+
+	if *baseline != "" {
+		evalOpts.KeepClasses = true
+	}
+
+	if *globalCache {
+		evalOpts.GlobalCache = shpeval.NewProjCache(*globalCacheSize)
+	}
+
+	ctx := context.Background()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	total := shpeval.NewFeedResult()
+
+	var cache *shpeval.ResultCache
+	if *cachePath != "" {
+		var err error
+		if cache, err = shpeval.LoadResultCache(*cachePath, evalOpts); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while reading result cache:", err)
+			os.Exit(1)
+		}
+	}
 
-	for _, gtfsPath := range gtfsPaths {
-		SHP_CACHE = make(map[*gtfs.Shape][][]float64)
+	start := time.Now()
 
-		loc_feed := gtfsparser.NewFeed()
-		opts := gtfsparser.ParseOptions{UseDefValueOnError: true, DropErroneous: true, CheckNullCoordinates: false, EmptyStringRepl: "", ZipFix: true}
-		loc_feed.SetParseOpts(opts)
+	results := shpeval.EvaluatePaths(ctx, gtfsPaths, evalOpts, shpeval.PoolOpts{Jobs: *jobs, MaxInflight: *maxInflight, Cache: cache, Progress: progErr})
 
-		fmt.Fprintf(os.Stdout, "Parsing GTFS feed in '%s' ...", gtfsPath)
-		e := loc_feed.Parse(gtfsPath)
+	timedOut := false
+	failed := make([]shpeval.FeedError, 0)
+	panicked := make([]shpeval.FeedError, 0)
+	var evaluated *shpeval.FeedResult
 
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "\nError while parsing GTFS feed:\n")
-			fmt.Fprintln(os.Stderr, e.Error())
+	for {
+		var res shpeval.FeedResult
+		var ok bool
+
+		// a stalled feed must not keep the summary from being printed
+		select {
+		case res, ok = <-results:
+		case <-ctx.Done():
+			timedOut = true
+		}
+
+		if timedOut || !ok {
+			break
+		}
+
+		// a feed crashing the parser or the evaluation must not end the whole run
+		if res.Panic != nil {
+			fmt.Fprintf(os.Stderr, "Panic while evaluating GTFS feed in '%s':\n", res.Path)
+			fmt.Fprintln(os.Stderr, res.Panic)
 			fmt.Fprintf(os.Stderr, "Skipping...\n")
+			panicked = append(panicked, shpeval.FeedError{Feed: res.Path, Error: fmt.Sprint(res.Panic)})
+			continue
+		}
+
+		if res.Canceled {
 			continue
 		}
-		fmt.Fprintf(os.Stdout, " done.\n")
-		num_feeds += 1
 
-		num_trips += len(loc_feed.Trips)
+		if res.Err != nil {
+			fmt.Fprintf(progOut, "Parsing GTFS feed in '%s' ...\n", res.Path)
+			fmt.Fprintf(os.Stderr, "Error while parsing GTFS feed in '%s':\n", res.Path)
+			fmt.Fprintln(os.Stderr, res.Err.Error())
+			fmt.Fprintf(os.Stderr, "Skipping...\n")
+			failed = append(failed, shpeval.FeedError{Feed: res.Path, Error: res.Err.Error()})
+			continue
+		}
+		fmt.Fprintf(progOut, "Parsing GTFS feed in '%s' ... done.\n", res.Path)
+		if *shapeLen {
+			fmt.Fprintf(logOut, "  %.2f km of distinct shape geometry\n", res.ShapeLength/1000.0)
+		}
+		if *timings {
+			fmt.Fprintf(logOut, "  parsed in %v, evaluated in %v\n", res.ParseTime.Round(time.Millisecond), res.EvalTime.Round(time.Millisecond))
+		}
+		total.Merge(res)
+		if *baseline != "" {
+			evaluated = &res
+		}
+
+		if res.WriteErr != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing feed '%s': %v\n", res.Path, res.WriteErr)
+			os.Exit(1)
+		}
+
+		if *reportDir != "" {
+			rep := shpeval.FeedReport{Feed: res.Path, Summary: shpeval.NewSummary(res, evalOpts, true, *byAgency), WorstTrips: make([]shpeval.SuspiciousTrip, 0)}
+			rep.WorstTrips = append(rep.WorstTrips, res.Worst...)
+			if err := shpeval.WriteFeedReport(*reportDir, rep); err != nil {
+				fmt.Fprintln(os.Stderr, "Error while writing feed report:", err)
+				os.Exit(1)
+			}
+		}
+
+		if csvW != nil {
+			csvW.WriteAll(res.CsvRows)
+		}
+		if worstStopsW != nil {
+			worstStopsW.WriteAll(shpeval.WorstStopRows(res.WorstStops, *units))
+		}
+		if *format == "tsv" {
+			writeTsv(sumOut, res.CsvRows)
+		}
+
+		geojson.Features = append(geojson.Features, res.Features...)
+	}
+
+	if csvW != nil {
+		csvW.Flush()
+		if err := csvW.Error(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing CSV output:", err)
+			os.Exit(1)
+		}
+	}
+
+	if worstStopsW != nil {
+		worstStopsW.Flush()
+		if err := worstStopsW.Error(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing worst stops output:", err)
+			os.Exit(1)
+		}
+	}
+
+	if geojsonF != nil {
+		if err := json.NewEncoder(geojsonF).Encode(geojson); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing GeoJSON output:", err)
+			os.Exit(1)
+		}
+	}
 
-		if len(loc_feed.Shapes) > 0 {
-			num_feeds_w_shps += 1
+	if gc := evalOpts.GlobalCache; gc != nil && *verbose {
+		hits, misses := gc.Stats()
+		rate := 0.0
+		if hits+misses > 0 {
+			rate = float64(hits) / float64(hits+misses) * 100.0
 		}
+		fmt.Fprintf(logOut, "Global shape cache: %d hits, %d misses (%.2f %% hit rate)\n", hits, misses, rate)
+	}
 
-		for _, trip := range loc_feed.Trips {
-			if trip.Shape == nil {
-				num_no_shp += 1
-			} else if len(trip.Shape.Points) == len(trip.StopTimes) {
-				num_deg += 1
-			} else if !check_shape(trip, loc_feed, *maxDist) {
-				num_err += 1
-			} else {
-				num_ok += 1
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing result cache:", err)
+		}
+	}
+
+	sum := shpeval.NewSummary(total, evalOpts, *byRouteType, *byAgency)
+
+	// with --jobs > 1, feeds fail in arbitrary order
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Feed < failed[j].Feed })
+	sort.Slice(panicked, func(i, j int) bool { return panicked[i].Feed < panicked[j].Feed })
+	sum.FailedFeeds = len(failed)
+	sum.Failed = failed
+	sum.PanickedFeeds = len(panicked)
+	sum.Panicked = panicked
+
+	if sum.Timings != nil {
+		sum.Timings.WallSec = time.Since(start).Seconds()
+	}
+
+	if *baseline != "" && evaluated != nil && !timedOut {
+		fmt.Fprintf(progErr, "parsing baseline %s\n", *baseline)
+		cmp, canceled, err := shpeval.CompareBaseline(ctx, *baseline, *evaluated, evalOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while evaluating baseline GTFS feed in '%s':\n%v\n", *baseline, err)
+			os.Exit(1)
+		}
+		if canceled {
+			timedOut = true
+		} else {
+			sum.Comparison = &cmp
+		}
+	}
+
+	if timedOut {
+		sum.Partial = true
+		fmt.Fprintf(os.Stderr, "Deadline of %v exceeded after %d of %d feeds\n", *deadline, total.Feeds, len(gtfsPaths))
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(sumOut)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(sum); err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing JSON summary:", err)
+			os.Exit(1)
+		}
+	} else if *format == "text" {
+		var colors *shpeval.SummaryColors
+		if *color == "always" || (*color == "auto" && os.Getenv("NO_COLOR") == "" && isTerminal(sumOut)) {
+			colors = &shpeval.SummaryColors{Red: COLOR_RED_UNDER, Yellow: COLOR_YELLOW_UNDER}
+			if flag.CommandLine.Changed("fail-under") {
+				colors = &shpeval.SummaryColors{Red: *failUnder, Yellow: *failUnder + COLOR_YELLOW_MARGIN}
 			}
 		}
+		shpeval.PrintColorTextSummary(sumOut, sum, colors)
+	}
+
+	if outF != nil {
+		err := outW.Flush()
+		if cerr := outF.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error while writing summary output:", err)
+			os.Exit(1)
+		}
+	}
+
+	if timedOut {
+		os.Exit(EXIT_DEADLINE)
 	}
 
-	fmt.Fprintf(os.Stdout, "\nAnalyzed %d feeds with %d trips\n", num_feeds, num_trips)
-	fmt.Fprintf(os.Stdout, "\n%d feeds had shapes (%.2f %%)\n", num_feeds_w_shps, float64(num_feeds_w_shps)/float64(num_trips))
-	fmt.Fprintf(os.Stdout, "\n%d trips with OK shape (%.2f %%), %d trips with suspicious shapes (%.2f %%), %d trips with degenerated shapes (%.2f %%), %d trips with no shapes (%.2f %%)\n", num_ok, float64(num_ok)/float64(num_trips)*100.0, num_err, float64(num_err)/float64(num_trips)*100.0, num_deg, float64(num_deg)/float64(num_trips)*100.0, num_no_shp, float64(num_no_shp)/float64(num_trips)*100.0)
+	if total.Trips == 0 {
+		os.Exit(EXIT_NO_TRIPS)
+	}
+
+	if flag.CommandLine.Changed("fail-under") && sum.ScorePct < *failUnder {
+		fmt.Fprintf(os.Stderr, "Score %.2f %% below required %.2f %%\n", sum.ScorePct, *failUnder)
+		os.Exit(EXIT_FAIL_UNDER)
+	}
 }
@@ -0,0 +1,172 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Results of earlier runs, keyed by feed path. An entry is only used if the
+// feed was not modified since and was evaluated with the same options.
+// Verbose per-trip lines are not part of a result, so with verbose options
+// every feed is evaluated again and only its result is stored.
+type ResultCache struct {
+	mu      sync.Mutex
+	path    string
+	key     string
+	verbose bool
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	// latest modification time of the feed, in nanoseconds, and its size
+	ModTime int64      `json:"mod_time"`
+	Size    int64      `json:"size"`
+	Opts    string     `json:"opts"`
+	Result  FeedResult `json:"result"`
+}
+
+// Reads the cache file at path for results evaluated with opts, a missing
+// file is an empty cache.
+func LoadResultCache(path string, opts Options) (*ResultCache, error) {
+	key, err := optsKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ResultCache{path: path, key: key, verbose: opts.Verbose, entries: make(map[string]cacheEntry)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&c.entries); err != nil {
+		return nil, fmt.Errorf("could not read result cache '%s': %v", path, err)
+	}
+
+	return c, nil
+}
+
+// the cached result of the feed at feedPath, false if there is none that is
+// still valid or the options are verbose. URLs are never cached.
+func (c *ResultCache) Get(feedPath string) (FeedResult, bool) {
+	mod, size, ok := feedStamp(feedPath)
+	if !ok || c.verbose {
+		return FeedResult{}, false
+	}
+
+	c.mu.Lock()
+	ent, ok := c.entries[feedPath]
+	c.mu.Unlock()
+
+	if !ok || ent.ModTime != mod || ent.Size != size || ent.Opts != c.key {
+		return FeedResult{}, false
+	}
+
+	// the time of the earlier run is not spent again
+	res := ent.Result
+	res.ParseTime, res.EvalTime = 0, 0
+	return res, true
+}
+
+// stores the result of the feed at feedPath, unless it is incomplete
+func (c *ResultCache) Put(feedPath string, res FeedResult) {
+	if res.Err != nil || res.Panic != nil || res.Canceled || res.WriteErr != nil {
+		return
+	}
+
+	mod, size, ok := feedStamp(feedPath)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries[feedPath] = cacheEntry{ModTime: mod, Size: size, Opts: c.key, Result: res}
+	c.mu.Unlock()
+}
+
+// writes the cache back to its file, replacing it only once fully written
+func (c *ResultCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".gtfs-shp-eval-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(c.entries); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// Latest modification time and total size of the feed at path. For feed
+// directories, these are taken over the files in it, as editing a file does
+// not change the directory itself. False if path can not be read, is a URL or
+// stdin.
+func feedStamp(path string) (int64, int64, bool) {
+	if IsUrl(path) || path == STDIN_PATH {
+		return 0, 0, false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if !fi.IsDir() {
+		return fi.ModTime().UnixNano(), fi.Size(), true
+	}
+
+	mod, size := fi.ModTime().UnixNano(), int64(0)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, e := range entries {
+		efi, err := e.Info()
+		if err != nil {
+			return 0, 0, false
+		}
+		if m := efi.ModTime().UnixNano(); m > mod {
+			mod = m
+		}
+		size += efi.Size()
+	}
+
+	return mod, size, true
+}
+
+// hash of the options that change the result of a feed
+func optsKey(opts Options) (string, error) {
+	opts.Log, opts.Progress, opts.Jsonl, opts.GlobalCache = nil, nil, nil, nil
+	opts.Verbose, opts.Timings = false, false
+
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("could not hash the options for the result cache: %v", err)
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
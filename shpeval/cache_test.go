@@ -0,0 +1,118 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// result of the feed in path, evaluated with opts and stored in a new cache
+// file, and the path of that file
+func cachedFixture(t *testing.T, path string, opts Options) (FeedResult, string) {
+	t.Helper()
+
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	c, err := LoadResultCache(cachePath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := evalFixture(t, path, opts)
+	c.Put(path, res)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	return res, cachePath
+}
+
+func TestResultCacheRoundTrip(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Top = 3
+	feed := fixtureWith(t, "distant", nil)
+	res, cachePath := cachedFixture(t, feed, opts)
+
+	c, err := LoadResultCache(cachePath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.Get(feed)
+	if !ok {
+		t.Fatal("no cached result for an unmodified feed")
+	}
+
+	want, _ := json.Marshal(NewSummary(res, opts, true, true))
+	if b, _ := json.Marshal(NewSummary(got, opts, true, true)); string(b) != string(want) {
+		t.Errorf("cached result differs:\ngot  %s\nwant %s", b, want)
+	}
+	if got.ParseTime != 0 || got.EvalTime != 0 {
+		t.Errorf("cached result took %v to parse and %v to evaluate, want 0", got.ParseTime, got.EvalTime)
+	}
+}
+
+func TestResultCacheMiss(t *testing.T) {
+	opts := DefaultOptions()
+
+	modified := func(t *testing.T, feed string) {
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(feed, "stops.txt"), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := func(t *testing.T, feed string) {
+		f, err := os.OpenFile(filepath.Join(feed, "stops.txt"), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("\n")
+		f.Close()
+	}
+
+	other := opts
+	other.MaxDist = 100
+	verbose := opts
+	verbose.Verbose = true
+
+	tests := []struct {
+		name   string
+		change func(*testing.T, string)
+		opts   Options
+	}{
+		{"newer file", modified, opts},
+		{"larger file", grown, opts},
+		{"other options", nil, other},
+		{"verbose", nil, verbose},
+	}
+
+	for _, tt := range tests {
+		feed := fixtureWith(t, "clean", nil)
+		_, cachePath := cachedFixture(t, feed, opts)
+		if tt.change != nil {
+			tt.change(t, feed)
+		}
+
+		c, err := LoadResultCache(cachePath, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.Get(feed); ok {
+			t.Errorf("%s: got a cached result, want none", tt.name)
+		}
+	}
+}
+
+func TestResultCacheUnhashableOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxDist = math.NaN()
+
+	if _, err := LoadResultCache(filepath.Join(t.TempDir(), "cache.json"), opts); err == nil {
+		t.Error("got a cache for options that can not be hashed, want an error")
+	}
+}
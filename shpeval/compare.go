@@ -0,0 +1,112 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// a trip whose class differs between the baseline and the evaluated feed
+type ClassChange struct {
+	TripId string    `json:"trip_id"`
+	Before TripClass `json:"before"`
+	After  TripClass `json:"after"`
+}
+
+// changes of the evaluated feed against an earlier version of it, trips are
+// matched by trip_id
+type Comparison struct {
+	Baseline string `json:"baseline"`
+	// trips that were OK or borderline in the baseline and are not anymore
+	Regressed []ClassChange `json:"regressed"`
+	// trips that are OK or borderline now and were not in the baseline
+	Improved []ClassChange `json:"improved"`
+	// trips only in the evaluated feed or only in the baseline
+	Added   int `json:"added_trips"`
+	Removed int `json:"removed_trips"`
+	// scores of both versions and their difference in percentage points
+	BaselineScorePct float64 `json:"baseline_score_pct"`
+	ScorePct         float64 `json:"score_pct"`
+	DeltaPct         float64 `json:"delta_pct"`
+}
+
+func isOkClass(c TripClass) bool {
+	return c == CLASS_OK || c == CLASS_BORDERLINE
+}
+
+// Compares the trip classes of res against those of the baseline base, both
+// evaluated with KeepClasses and opts.
+func CompareResults(base FeedResult, res FeedResult, opts Options) Comparison {
+	cmp := Comparison{
+		Baseline:         base.Path,
+		Regressed:        make([]ClassChange, 0),
+		Improved:         make([]ClassChange, 0),
+		BaselineScorePct: NewSummary(base, opts, false, false).ScorePct,
+		ScorePct:         NewSummary(res, opts, false, false).ScorePct,
+	}
+	cmp.DeltaPct = cmp.ScorePct - cmp.BaselineScorePct
+
+	for id, after := range res.Classes {
+		before, ok := base.Classes[id]
+		if !ok {
+			cmp.Added += 1
+			continue
+		}
+		if isOkClass(before) && !isOkClass(after) {
+			cmp.Regressed = append(cmp.Regressed, ClassChange{TripId: id, Before: before, After: after})
+		} else if !isOkClass(before) && isOkClass(after) {
+			cmp.Improved = append(cmp.Improved, ClassChange{TripId: id, Before: before, After: after})
+		}
+	}
+
+	for id := range base.Classes {
+		if _, ok := res.Classes[id]; !ok {
+			cmp.Removed += 1
+		}
+	}
+
+	sort.Slice(cmp.Regressed, func(i, j int) bool { return cmp.Regressed[i].TripId < cmp.Regressed[j].TripId })
+	sort.Slice(cmp.Improved, func(i, j int) bool { return cmp.Improved[i].TripId < cmp.Improved[j].TripId })
+
+	return cmp
+}
+
+// Evaluates the earlier version of the feed at baselinePath and compares res,
+// evaluated with KeepClasses and opts, against it. The baseline is evaluated
+// with opts, but without any outputs besides its trip classes. canceled is
+// true if ctx was done before the baseline was evaluated completely.
+func CompareBaseline(ctx context.Context, baselinePath string, res FeedResult, opts Options) (cmp Comparison, canceled bool, err error) {
+	baseOpts := opts
+	baseOpts.Csv, baseOpts.GeoJson, baseOpts.Jsonl, baseOpts.Verbose, baseOpts.Top = false, false, nil, false, 0
+	baseOpts.WriteGtfs, baseOpts.WorstStops, baseOpts.WorstTrips = "", 0, 0
+	baseOpts.KeepClasses = true
+
+	base := EvaluatePath(ctx, baselinePath, baseOpts)
+	if base.Panic != nil {
+		return cmp, false, fmt.Errorf("evaluation failed: %v", base.Panic)
+	}
+	if base.Err != nil {
+		return cmp, false, base.Err
+	}
+	if base.Canceled {
+		return cmp, true, nil
+	}
+
+	return CompareResults(base, res, opts), false, nil
+}
+
+func printComparison(w io.Writer, cmp *Comparison) {
+	fmt.Fprintf(w, "\nCompared to baseline '%s': score %.2f %% -> %.2f %% (%+.2f percentage points), %d trips regressed, %d trips improved, %d trips added, %d trips removed\n", cmp.Baseline, cmp.BaselineScorePct, cmp.ScorePct, cmp.DeltaPct, len(cmp.Regressed), len(cmp.Improved), cmp.Added, cmp.Removed)
+
+	for _, c := range cmp.Regressed {
+		fmt.Fprintf(w, "  regressed '%s': %s -> %s\n", c.TripId, c.Before, c.After)
+	}
+	for _, c := range cmp.Improved {
+		fmt.Fprintf(w, "  improved '%s': %s -> %s\n", c.TripId, c.Before, c.After)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// The trip of the distant feed becomes OK with the shape of the clean feed,
+// a trip only in the new version counts as added.
+func TestCompareBaseline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.KeepClasses = true
+
+	path := fixtureWith(t, "clean", map[string]string{
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\nt1,08:00:00,08:00:00,st0,1\nt1,08:01:00,08:01:00,st1,2\nt1,08:02:00,08:02:00,st2,3\nt2,09:00:00,09:00:00,st0,1\nt2,09:01:00,09:01:00,st1,2\nt2,09:02:00,09:02:00,st2,3\n",
+		"trips.txt":      "route_id,service_id,trip_id,shape_id\nR,S,t1,s1\nR,S,t2,s1\n",
+	})
+	res := evalFixture(t, path, opts)
+	res.Path = path
+
+	cmp, canceled, err := CompareBaseline(context.Background(), filepath.Join("..", "testdata", "distant"), res, opts)
+	if err != nil || canceled {
+		t.Fatalf("got error %v, canceled %v", err, canceled)
+	}
+	if len(cmp.Improved) != 1 || cmp.Improved[0].TripId != "t1" || len(cmp.Regressed) != 0 || cmp.Added != 1 || cmp.Removed != 0 {
+		t.Errorf("got %+v, want t1 improved and one trip added", cmp)
+	}
+	if cmp.BaselineScorePct != 0 || cmp.ScorePct != 100 || cmp.DeltaPct != 100 {
+		t.Errorf("got scores %.2f %% -> %.2f %% (%+.2f), want 0 %% -> 100 %%", cmp.BaselineScorePct, cmp.ScorePct, cmp.DeltaPct)
+	}
+
+	// the baseline is not evaluated anymore
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, canceled, err := CompareBaseline(ctx, filepath.Join("..", "testdata", "distant"), res, opts); err != nil || !canceled {
+		t.Errorf("got error %v, canceled %v after the deadline, want canceled", err, canceled)
+	}
+
+	if _, _, err := CompareBaseline(context.Background(), filepath.Join(t.TempDir(), "missing"), res, opts); err == nil {
+		t.Error("got no error for a missing baseline")
+	}
+}
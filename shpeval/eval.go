@@ -0,0 +1,1738 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"github.com/patrickbr/gtfswriter"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// interval of the per-feed trip counter on the progress output
+var PROGRESS_TRIPS int = 100000
+
+// classification of a trip's shape
+type TripClass string
+
+const (
+	CLASS_OK         TripClass = "ok"
+	CLASS_BORDERLINE TripClass = "borderline"
+	CLASS_SUSPICIOUS TripClass = "suspicious"
+	CLASS_DEGENERATE TripClass = "degenerate"
+	CLASS_MALFORMED  TripClass = "malformed"
+	// the trip references a shape that has no points, e.g. because all of
+	// them were dropped while parsing
+	CLASS_EMPTY_SHAPE TripClass = "empty_shape"
+	CLASS_REVERSED    TripClass = "reversed"
+	CLASS_NO_SHAPE    TripClass = "no_shape"
+)
+
+type Options struct {
+	MaxDist       float64
+	MaxDistByType map[int16]float64
+	// trips whose worst stop is farther than this but within their max
+	// distance are borderline, 0 to disable
+	WarnDist float64
+	// derive the max distance of each feed from its own stop distances
+	AutoDist       bool
+	AutoDistPct    float64
+	AutoDistMargin float64
+	DistMode       string
+	CollinearTol   float64
+	MinLenRatio    float64
+	MaxDetour      float64
+	// max distance of each stop as this fraction of its spacing to the
+	// neighboring stops, at least the trip's max distance and at most
+	// MaxDistFracCap. 0 to disable
+	MaxDistFrac    float64
+	MaxDistFracCap float64
+	// flag trips whose shape runs longer than this many meters before their
+	// first or after their last stop, 0 to disable
+	MaxTail float64
+	// flag trips with more than this fraction of their shape points outside
+	// the bounding box of their stops expanded by the max distance, 0 to
+	// disable
+	MaxOutsideBBox float64
+	// flag trips whose shape is shorter than this fraction of the median
+	// shape length of their route type, 0 to disable
+	MinLengthRatio float64
+	// max difference of stop and shape direction in degrees, 0 to disable
+	MaxBearingDiff float64
+	MaxDensity     float64
+	MinDensity     float64
+	ShapeLength    bool
+	SelfIntersect  bool
+	OrphanStops    bool
+	// flag trips whose stops snap to less than this fraction of distinct
+	// positions along the shape as placeholders, 0 to disable
+	PlaceholderRatio float64
+	// check shape_dist_traveled of shapes and stop times for consistency
+	CheckDistTraveled bool
+	// weight of each stop by stop_id, e.g. its boardings, to sum over the stops
+	// beyond the max distance of suspicious trips. Disabled if nil, stops not
+	// in it weigh 0
+	StopWeights map[string]float64
+	// group shapes whose points are all within Epsilon of each other
+	FindDupShapes bool
+	// flag trips whose stops have a Jaccard similarity below this to those of
+	// the most common stop pattern of their shape, 0 to disable
+	MinStopSimilarity float64
+	// coordinates at most this many meters apart are equal
+	Epsilon  float64
+	Coverage bool
+	// split the stop distances into cross-track and along-track offsets
+	Offsets bool
+	// Douglas-Peucker tolerance in meters, 0 to disable
+	Simplify float64
+	// directory to write the feeds with simplified shapes to, none if empty
+	WriteGtfs     string
+	Stats         bool
+	Histogram     []float64
+	SortShapes    bool
+	DedupPoints   bool
+	IgnoreNonStop bool
+	// leave out stops at 0,0 or with NaN coordinates, and trips without any other stop
+	SkipNullCoords bool
+	// report the bounding boxes of the stops and shapes of each feed
+	BBox bool
+	// leave out trips with less than this many stop times, 0 to disable
+	MinStops      int
+	RequireShapes bool
+	// trips the score is computed over, 'all', 'shaped' or 'nondegenerate'. If
+	// empty, all trips with RequireShapes and trips with a shape otherwise
+	OkBasis string
+	// fraction of trips to evaluate, all trips if 0 or 1
+	Sample          float64
+	Seed            int64
+	WeightByService bool
+	Timeout         time.Duration
+	ParseOpts       gtfsparser.ParseOptions
+	Csv             bool
+	GeoJson         bool
+	// receives one JSON object per evaluated trip as evaluation proceeds, if
+	// not nil. Must be safe for concurrent use.
+	Jsonl   io.Writer
+	Verbose bool
+	// report the time spent parsing and evaluating
+	Timings bool
+	// unit of the distances in Csv, GeoJson and log output, one of UNITS,
+	// meters if empty
+	Units string
+	// only evaluate trips of these routes or with these ids, all if both are empty
+	Routes map[string]bool
+	Trips  map[string]bool
+	// keep the class of each trip in FeedResult.Classes
+	KeepClasses bool
+	// number of suspicious trips with the most distant stops to keep, 0 for none
+	WorstTrips int
+	// number of trips of any class with the most distant stops to keep, 0 for none
+	Top int
+	// number of stops of each feed farthest from the shape of any trip
+	// serving them to keep, 0 for none
+	WorstStops int
+	Log        io.Writer
+	// projections shared across feeds, if not nil
+	GlobalCache *ProjCache
+	// decimal places coordinates are rounded to before shapes are hashed for
+	// GlobalCache and FindDupShapes
+	HashPrecision int
+	// receives a trip counter while evaluating large feeds, if not nil
+	Progress io.Writer
+	// evaluate the trips grouped by shape and drop the cached projections of
+	// each shape after its last trip, instead of keeping all of them for the
+	// whole feed. Stop snaps are still kept for the whole feed with AutoDist.
+	LowMemory bool
+}
+
+// the score basis in effect for opts
+func (opts Options) okBasis() string {
+	if opts.OkBasis != "" {
+		return opts.OkBasis
+	}
+	if opts.RequireShapes {
+		return "all"
+	}
+	return "shaped"
+}
+
+// max stop-to-shape distance for the trip, depending on its route type
+func (opts Options) maxDistFor(trip *gtfs.Trip) float64 {
+	if trip.Route != nil {
+		if d, ok := opts.MaxDistByType[trip.Route.Type]; ok {
+			return d
+		}
+	}
+	return opts.MaxDist
+}
+
+// true if the trip passes the Routes and Trips filters
+func (opts Options) matches(trip *gtfs.Trip) bool {
+	if len(opts.Routes) == 0 && len(opts.Trips) == 0 {
+		return true
+	}
+	return opts.Trips[trip.Id] || (trip.Route != nil && opts.Routes[trip.Route.Id])
+}
+
+// number of trips per classification
+type Counts struct {
+	Trips      int `json:"trips"`
+	Ok         int `json:"ok"`
+	Borderline int `json:"borderline"`
+	Suspicious int `json:"suspicious"`
+	Degenerate int `json:"degenerate"`
+	Malformed  int `json:"malformed"`
+	EmptyShape int `json:"empty_shape"`
+	Reversed   int `json:"reversed"`
+	NoShape    int `json:"no_shape"`
+}
+
+func (c *Counts) add(class TripClass) {
+	c.Trips += 1
+	switch class {
+	case CLASS_OK:
+		c.Ok += 1
+	case CLASS_BORDERLINE:
+		c.Borderline += 1
+	case CLASS_SUSPICIOUS:
+		c.Suspicious += 1
+	case CLASS_DEGENERATE:
+		c.Degenerate += 1
+	case CLASS_MALFORMED:
+		c.Malformed += 1
+	case CLASS_EMPTY_SHAPE:
+		c.EmptyShape += 1
+	case CLASS_REVERSED:
+		c.Reversed += 1
+	case CLASS_NO_SHAPE:
+		c.NoShape += 1
+	}
+}
+
+func scaleCount(n int, f float64) int {
+	return int(math.Round(float64(n) * f))
+}
+
+// counts extrapolated by factor f
+func (c Counts) scaled(f float64) Counts {
+	return Counts{
+		Trips:      scaleCount(c.Trips, f),
+		Ok:         scaleCount(c.Ok, f),
+		Borderline: scaleCount(c.Borderline, f),
+		Suspicious: scaleCount(c.Suspicious, f),
+		Degenerate: scaleCount(c.Degenerate, f),
+		Malformed:  scaleCount(c.Malformed, f),
+		EmptyShape: scaleCount(c.EmptyShape, f),
+		Reversed:   scaleCount(c.Reversed, f),
+		NoShape:    scaleCount(c.NoShape, f),
+	}
+}
+
+func (c *Counts) merge(o Counts) {
+	c.Trips += o.Trips
+	c.Ok += o.Ok
+	c.Borderline += o.Borderline
+	c.Suspicious += o.Suspicious
+	c.Degenerate += o.Degenerate
+	c.Malformed += o.Malformed
+	c.EmptyShape += o.EmptyShape
+	c.Reversed += o.Reversed
+	c.NoShape += o.NoShape
+}
+
+type FeedResult struct {
+	Counts
+	Path  string
+	Err   error       `json:"-"`
+	Panic interface{} `json:"-"`
+	// evaluation was canceled, the counters are incomplete
+	Canceled bool
+	// time spent parsing and evaluating, summed over the feeds
+	ParseTime time.Duration
+	EvalTime  time.Duration
+	// max number of shapes with cached projections at once, in any feed
+	PeakCachedShapes int
+	Feeds            int
+	// all trips of the feeds, including those not sampled
+	AllTrips        int
+	FeedsWithShapes int
+	// distinct shapes of the feeds and the trips of the feeds using any
+	Shapes         int
+	ShapedTrips    int
+	ByRouteType    map[int16]*Counts
+	ByAgency       map[string]*Counts
+	DegReasons     map[string]int
+	BadSeq         int
+	DupPointShapes int
+	DupPoints      int
+	NonStops       int
+	// one per feed with BBox
+	BBoxes []FeedBBox
+	// stops without coordinates that got those of their parent station
+	ParentCoordStops int
+	// stop times and trips left out with SkipNullCoords
+	NullStops int
+	NullTrips int
+	// trips left out for having less than MinStops stop times
+	FewStopTrips int
+	SavedEvals   int
+	Weighted     map[string]float64
+	Detours      []float64
+	NumDetour    int
+	StopDists    []float64
+	Densities    []float64
+	// per trip, the percentage of the shape's length near one of its stops
+	Coverages []float64
+	// cross-track and along-track offsets of the stops with Offsets, and
+	// those of them beyond the start or end of their shape
+	CrossOffsets []float64
+	AlongOffsets []float64
+	BeyondEnds   int
+	// per trip with a shape, its number of shape points per stop time
+	PointRatios   []float64
+	PointRatioOne int
+	NumOverDense  int
+	NumUnderDense int
+	ShapeLength   float64
+	NumSelfInters int
+	Antimeridian  int
+	OutOfOrder    int
+	Impossible    int
+	Placeholder   int
+	// stops beyond the max distance of suspicious trips and the sum of their
+	// StopWeights
+	ImpactStops int
+	Impact      float64
+	// shapes and trips with shape_dist_traveled on all points checked with
+	// CheckDistTraveled, those decreasing along the shape or the trip, and the
+	// stop times outside of their shape's range
+	DistTravShapes    int
+	DistTravDecShapes int
+	DistTravTrips     int
+	DistTravDecTrips  int
+	DistTravOutside   int
+	Truncated         int
+	ShortTrips        int
+	// trips with a tail longer than MaxTail and the lengths of those tails
+	TailTrips int
+	Tails     []float64
+	// trips with more than MaxOutsideBBox of their shape points outside the
+	// stops' bounding box and those fractions
+	OutsideBBoxTrips int
+	OutsideBBoxFracs []float64
+	// max distance derived for each feed with AutoDist
+	AutoDists []float64
+	// max distance of each measured stop with MaxDistFrac
+	FracMaxDists   []float64
+	BadBearing     int
+	TruncatedEnds  int
+	TruncatedGaps  float64
+	NumOrphanStops int
+	// groups of shapes with identical geometry, the shapes beyond the first
+	// of each group and their points
+	DupShapeGroups int
+	DupShapes      int
+	DupShapePoints int
+	// shapes used by trips with divergent stops and those trips
+	DivergentShapes int
+	DivergentTrips  int
+	SimplifyPoints  int
+	SimplifyDropped int
+	SimplifyRejects int
+	Worst           []SuspiciousTrip
+	// class of each evaluated trip by trip id, only with KeepClasses and not
+	// merged
+	Classes map[string]TripClass
+	Top     []SuspiciousTrip
+	// stops farthest from a shape, only with WorstStops and not merged
+	WorstStops []WorstStop
+	WriteErr   error `json:"-"`
+	CsvRows    [][]string
+	Features   []GeoJsonFeature
+}
+
+func NewFeedResult() FeedResult {
+	return FeedResult{
+		ByRouteType: make(map[int16]*Counts),
+		ByAgency:    make(map[string]*Counts),
+		DegReasons:  make(map[string]int),
+		Weighted:    make(map[string]float64),
+		Classes:     make(map[string]TripClass),
+	}
+}
+
+// adds the counters and top trips of o to r, worst trips, CSV rows and GeoJSON
+// features are not merged
+func (r *FeedResult) Merge(o FeedResult) {
+	r.Counts.merge(o.Counts)
+	r.Feeds += o.Feeds
+	r.ParseTime += o.ParseTime
+	r.EvalTime += o.EvalTime
+	if o.PeakCachedShapes > r.PeakCachedShapes {
+		r.PeakCachedShapes = o.PeakCachedShapes
+	}
+	r.AllTrips += o.AllTrips
+	r.FeedsWithShapes += o.FeedsWithShapes
+	r.Shapes += o.Shapes
+	r.ShapedTrips += o.ShapedTrips
+	for t, c := range o.ByRouteType {
+		if _, ok := r.ByRouteType[t]; !ok {
+			r.ByRouteType[t] = &Counts{}
+		}
+		r.ByRouteType[t].merge(*c)
+	}
+	for a, c := range o.ByAgency {
+		if _, ok := r.ByAgency[a]; !ok {
+			r.ByAgency[a] = &Counts{}
+		}
+		r.ByAgency[a].merge(*c)
+	}
+	for d, n := range o.DegReasons {
+		r.DegReasons[d] += n
+	}
+	r.BadSeq += o.BadSeq
+	r.DupPointShapes += o.DupPointShapes
+	r.DupPoints += o.DupPoints
+	r.NonStops += o.NonStops
+	r.BBoxes = append(r.BBoxes, o.BBoxes...)
+	r.ParentCoordStops += o.ParentCoordStops
+	r.NullStops += o.NullStops
+	r.NullTrips += o.NullTrips
+	r.FewStopTrips += o.FewStopTrips
+	r.SavedEvals += o.SavedEvals
+	for c, w := range o.Weighted {
+		r.Weighted[c] += w
+	}
+	r.Detours = append(r.Detours, o.Detours...)
+	r.NumDetour += o.NumDetour
+	r.StopDists = append(r.StopDists, o.StopDists...)
+	r.Densities = append(r.Densities, o.Densities...)
+	r.Coverages = append(r.Coverages, o.Coverages...)
+	r.PointRatios = append(r.PointRatios, o.PointRatios...)
+	r.CrossOffsets = append(r.CrossOffsets, o.CrossOffsets...)
+	r.AlongOffsets = append(r.AlongOffsets, o.AlongOffsets...)
+	r.BeyondEnds += o.BeyondEnds
+	r.PointRatioOne += o.PointRatioOne
+	r.NumOverDense += o.NumOverDense
+	r.NumUnderDense += o.NumUnderDense
+	r.ShapeLength += o.ShapeLength
+	r.NumSelfInters += o.NumSelfInters
+	r.Antimeridian += o.Antimeridian
+	r.OutOfOrder += o.OutOfOrder
+	r.Impossible += o.Impossible
+	r.Placeholder += o.Placeholder
+	r.ImpactStops += o.ImpactStops
+	r.Impact += o.Impact
+	r.DistTravShapes += o.DistTravShapes
+	r.DistTravDecShapes += o.DistTravDecShapes
+	r.DistTravTrips += o.DistTravTrips
+	r.DistTravDecTrips += o.DistTravDecTrips
+	r.DistTravOutside += o.DistTravOutside
+	r.Truncated += o.Truncated
+	r.ShortTrips += o.ShortTrips
+	r.TailTrips += o.TailTrips
+	r.Tails = append(r.Tails, o.Tails...)
+	r.OutsideBBoxTrips += o.OutsideBBoxTrips
+	r.OutsideBBoxFracs = append(r.OutsideBBoxFracs, o.OutsideBBoxFracs...)
+	r.AutoDists = append(r.AutoDists, o.AutoDists...)
+	r.FracMaxDists = append(r.FracMaxDists, o.FracMaxDists...)
+	r.BadBearing += o.BadBearing
+	r.TruncatedEnds += o.TruncatedEnds
+	r.TruncatedGaps += o.TruncatedGaps
+	r.NumOrphanStops += o.NumOrphanStops
+	r.DupShapeGroups += o.DupShapeGroups
+	r.DupShapes += o.DupShapes
+	r.DupShapePoints += o.DupShapePoints
+	r.DivergentShapes += o.DivergentShapes
+	r.DivergentTrips += o.DivergentTrips
+	r.SimplifyPoints += o.SimplifyPoints
+	r.SimplifyDropped += o.SimplifyDropped
+	r.SimplifyRejects += o.SimplifyRejects
+	r.Top = append(r.Top, o.Top...)
+}
+
+// evaluates the shapes of GTFS feeds and collects the results in Res
+type Evaluator struct {
+	Opts Options
+	Res  FeedResult
+
+	// label of the feed currently evaluated, used in logs and outputs
+	FeedPath string
+	// if not nil, EvaluateFeed stops early and sets Res.Canceled once it is done
+	Ctx context.Context
+
+	feed *gtfsparser.Feed
+	// Opts.DistMode, with 'utm' resolved to the zone of the feed
+	distMode string
+	// max distance derived for the current feed with AutoDist
+	autoDist   float64
+	shpCache   *shapeCache
+	snapsCache map[snapKey][]StopSnap
+	// snaps computed while deriving autoDist, not yet used by any trip
+	prefetched map[snapKey]bool
+	coverages  map[coverageKey]float64
+	// shape_dist_traveled range of each shape that has it on all points
+	distRanges map[*gtfs.Shape][2]float32
+	svcDays    map[*gtfs.Service]int
+	// class of each trip by trip id, only kept for writing feeds
+	classes map[string]TripClass
+	// max distance of each stop to the shape of a trip serving it
+	stopWorst map[*gtfs.Stop]WorstStop
+}
+
+func NewEvaluator(opts Options) *Evaluator {
+	return &Evaluator{
+		Opts:       opts,
+		Res:        NewFeedResult(),
+		distMode:   opts.DistMode,
+		shpCache:   &shapeCache{distMode: opts.DistMode, global: opts.GlobalCache, hashPrec: opts.HashPrecision},
+		snapsCache: make(map[snapKey][]StopSnap),
+		svcDays:    make(map[*gtfs.Service]int),
+	}
+}
+
+// evaluation of a single trip
+type tripEval struct {
+	// the trip as evaluated, without non-stopping stop times if these are ignored
+	Trip     *gtfs.Trip
+	Class    TripClass
+	NonStops int
+	// stop times left out with SkipNullCoords, and whether that left none
+	NullStops int
+	NullTrip  bool
+	MaxDist   float64
+	// per stop with MaxDistFrac, MaxDist for all stops otherwise
+	StopMaxDists []float64
+	DegReason    string
+	Detour       float64
+	HasDetour    bool
+	// fraction of shape points outside the stops' bounding box, with
+	// MaxOutsideBBox
+	OutsideBBox    float64
+	HasOutsideBBox bool
+	Snaps          []StopSnap
+	Dists          []float64
+	Reused         bool
+	WorstIdx       int
+	WorstDist      float64
+	// the shape is shorter than the distance between the terminal stops
+	Impossible bool
+	StopSpan   float64
+	// index of the first stop out of order along the shape, -1 if none
+	OutOfOrder int
+	// meters by which the shape ends short of the first and last stop
+	StartGap float64
+	EndGap   float64
+	// meters of shape before the first and after the last stop, with MaxTail
+	StartTail float64
+	EndTail   float64
+	// index of the first stop disagreeing with the shape's direction, -1 if none
+	BearingIdx  int
+	BearingDiff float64
+}
+
+func (e *Evaluator) evaluateTrip(trip *gtfs.Trip) (te tripEval) {
+	te.OutOfOrder = -1
+	te.BearingIdx = -1
+	te.Trip, te.NonStops, te.NullStops = e.filterStops(trip)
+	trip = te.Trip
+	if e.Opts.SkipNullCoords && te.NullStops > 0 && len(trip.StopTimes) == 0 {
+		te.NullTrip = true
+		return
+	}
+
+	if trip.Shape == nil {
+		te.Class = CLASS_NO_SHAPE
+		return
+	}
+
+	if len(trip.Shape.Points) == 0 {
+		te.Class = CLASS_EMPTY_SHAPE
+		return
+	}
+
+	// no segment to measure the stops against
+	if len(trip.Shape.Points) < 2 {
+		te.Class = CLASS_MALFORMED
+		return
+	}
+
+	te.MaxDist = e.maxDistFor(trip)
+
+	// cheap screen before the stops are snapped
+	cum := e.shpCache.cumLengths(trip.Shape)
+	te.StopSpan, te.Impossible = impossibleShape(trip, cum[len(cum)-1], te.MaxDist, e.distMode)
+
+	te.DegReason = degenerateReason(trip, e.distMode, e.Opts.Epsilon, e.Opts.CollinearTol, e.Opts.MinLenRatio, e.Opts.MinDensity)
+	deg := te.DegReason != ""
+
+	if !deg && e.Opts.MaxDetour > 0 {
+		te.Detour, te.HasDetour = detourFactor(trip, e.distMode, te.MaxDist)
+	}
+
+	if !deg && e.Opts.MaxOutsideBBox > 0 {
+		te.OutsideBBox, te.HasOutsideBBox = outsideStopBBox(trip, te.MaxDist)
+	}
+
+	if !deg || e.Opts.Csv {
+		te.Snaps, te.Reused = e.tripSnaps(trip)
+		te.Dists = snapDists(te.Snaps)
+	}
+
+	if deg {
+		te.Class = CLASS_DEGENERATE
+		return
+	}
+
+	if isReversed(trip, te.Snaps, cum[len(cum)-1], te.MaxDist, e.distMode) {
+		te.Class = CLASS_REVERSED
+		return
+	}
+
+	te.OutOfOrder = outOfOrderStop(te.Snaps)
+	te.StartGap, te.EndGap = terminalGaps(te.Snaps, cum[len(cum)-1], te.MaxDist)
+	if e.Opts.MaxTail > 0 {
+		te.StartTail, te.EndTail = shapeTails(te.Snaps, cum[len(cum)-1])
+	}
+	if e.Opts.MaxBearingDiff > 0 {
+		te.BearingIdx, te.BearingDiff = bearingViolation(trip, te.Snaps, e.shpCache.projected(trip.Shape), e.distMode, e.Opts.MaxBearingDiff, te.MaxDist)
+	}
+
+	te.StopMaxDists = make([]float64, len(te.Dists))
+	if e.Opts.MaxDistFrac > 0 {
+		te.StopMaxDists = spacingMaxDists(trip, e.distMode, e.Opts.MaxDistFrac, te.MaxDist, e.Opts.MaxDistFracCap)
+	} else {
+		for i := range te.StopMaxDists {
+			te.StopMaxDists[i] = te.MaxDist
+		}
+	}
+
+	exceeded := false
+	for i, d := range te.Dists {
+		if d > te.StopMaxDists[i] {
+			exceeded = true
+		}
+	}
+
+	te.WorstIdx, te.WorstDist = worstStop(te.Dists)
+	if exceeded {
+		te.Class = CLASS_SUSPICIOUS
+	} else if e.Opts.WarnDist > 0 && te.WorstDist > e.Opts.WarnDist {
+		te.Class = CLASS_BORDERLINE
+	} else {
+		te.Class = CLASS_OK
+	}
+	return
+}
+
+// stop snaps of the trip, shared by all trips with identical shape and stops,
+// and whether they were computed for an earlier trip
+func (e *Evaluator) tripSnaps(trip *gtfs.Trip) ([]StopSnap, bool) {
+	key := tripSnapKey(trip)
+	if cached, ok := e.snapsCache[key]; ok {
+		if e.prefetched[key] {
+			delete(e.prefetched, key)
+			return cached, false
+		}
+		return cached, true
+	}
+
+	snaps := check_shape(trip, e.feed, e.distMode, e.shpCache)
+	e.snapsCache[key] = snaps
+	return snaps, false
+}
+
+type coverageKey struct {
+	snapKey
+	maxDist float64
+}
+
+// percentage of the trip's shape length within maxDist of one of its stops,
+// shared by all trips with identical shape and stops
+func (e *Evaluator) coverage(trip *gtfs.Trip, maxDist float64) (float64, bool) {
+	key := coverageKey{tripSnapKey(trip), maxDist}
+	if c, ok := e.coverages[key]; ok {
+		return c, c >= 0
+	}
+
+	c, ok := coveredFraction(trip, e.shpCache.projected(trip.Shape), e.shpCache.cumLengths(trip.Shape), maxDist, e.distMode)
+	if !ok {
+		e.coverages[key] = -1
+		return 0, false
+	}
+
+	e.coverages[key] = c * 100
+	return c * 100, true
+}
+
+// route type of the trip, -1 if it has no route
+func routeType(trip *gtfs.Trip) int16 {
+	if trip.Route == nil {
+		return -1
+	}
+	return trip.Route.Type
+}
+
+// id of the trip's route, empty if it has no route
+func routeId(trip *gtfs.Trip) string {
+	if trip.Route == nil {
+		return ""
+	}
+	return trip.Route.Id
+}
+
+// median shape length of the trips of each route type, over trips with a
+// shape of at least 2 points
+func (e *Evaluator) medianShapeLengths(trips []*gtfs.Trip) map[int16]float64 {
+	lens := make(map[int16][]float64)
+	for _, trip := range trips {
+		if trip.Shape == nil || len(trip.Shape.Points) < 2 {
+			continue
+		}
+		cum := e.shpCache.cumLengths(trip.Shape)
+		lens[routeType(trip)] = append(lens[routeType(trip)], cum[len(cum)-1])
+	}
+
+	ret := make(map[int16]float64)
+	for t, l := range lens {
+		sort.Float64s(l)
+		ret[t] = percentile(l, 50)
+	}
+	return ret
+}
+
+// max stop-to-shape distance for the trip, the one derived for the feed with AutoDist
+func (e *Evaluator) maxDistFor(trip *gtfs.Trip) float64 {
+	if e.Opts.AutoDist {
+		return e.autoDist
+	}
+	return e.Opts.maxDistFor(trip)
+}
+
+// Max distance derived from the stop-to-shape distances of all trips with a
+// non-degenerate shape: their AutoDistPct percentile plus AutoDistMargin.
+// The snaps are kept for the evaluation of the trips.
+func (e *Evaluator) autoMaxDist(trips []*gtfs.Trip) float64 {
+	var rng *rand.Rand
+	if e.Opts.Sample > 0 && e.Opts.Sample < 1 {
+		// same selection as in EvaluateFeed
+		rng = rand.New(rand.NewSource(e.Opts.Seed))
+	}
+
+	dists := make([]float64, 0)
+	for _, trip := range trips {
+		if rng != nil && rng.Float64() >= e.Opts.Sample {
+			continue
+		}
+		trip, _, _ = e.filterStops(trip)
+		if trip.Shape == nil || len(trip.Shape.Points) < 2 || degenerateReason(trip, e.distMode, e.Opts.Epsilon, e.Opts.CollinearTol, e.Opts.MinLenRatio, e.Opts.MinDensity) != "" {
+			continue
+		}
+
+		key := tripSnapKey(trip)
+		if _, ok := e.snapsCache[key]; !ok {
+			e.snapsCache[key] = check_shape(trip, e.feed, e.distMode, e.shpCache)
+			e.prefetched[key] = true
+		}
+		dists = append(dists, snapDists(e.snapsCache[key])...)
+	}
+
+	sort.Float64s(dists)
+	return percentile(dists, e.Opts.AutoDistPct) + e.Opts.AutoDistMargin
+}
+
+// The trip without the stop times left out by IgnoreNonStop and
+// SkipNullCoords, and the number of each of them. All evaluations of a trip go
+// through this, so that they see the same stops.
+func (e *Evaluator) filterStops(trip *gtfs.Trip) (*gtfs.Trip, int, int) {
+	nonStops, nullStops := 0, 0
+	if e.Opts.IgnoreNonStop {
+		trip, nonStops = withoutNonStops(trip)
+	}
+	if e.Opts.SkipNullCoords {
+		trip, nullStops = withoutNullStops(trip)
+	}
+	return trip, nonStops, nullStops
+}
+
+// classifies the shape of a single trip, without touching the counters. Stop
+// times are left out as in EvaluateFeed.
+func (e *Evaluator) Classify(trip *gtfs.Trip) TripClass {
+	return e.evaluateTrip(trip).Class
+}
+
+func (e *Evaluator) count(trip *gtfs.Trip, class TripClass, weight float64) {
+	e.Res.add(class)
+	e.Res.Weighted[string(class)] += weight
+
+	if trip.Route != nil {
+		if _, ok := e.Res.ByRouteType[trip.Route.Type]; !ok {
+			e.Res.ByRouteType[trip.Route.Type] = &Counts{}
+		}
+		e.Res.ByRouteType[trip.Route.Type].add(class)
+
+		if a := agencyLabel(trip.Route.Agency); a != "" {
+			if _, ok := e.Res.ByAgency[a]; !ok {
+				e.Res.ByAgency[a] = &Counts{}
+			}
+			e.Res.ByAgency[a].add(class)
+		}
+	}
+}
+
+// evaluates all trips of a parsed feed and adds them to the counters
+func (e *Evaluator) EvaluateFeed(feed *gtfsparser.Feed) {
+	opts := e.Opts
+
+	// caches are keyed by shape and service pointers, which are only valid for one feed
+	e.feed = feed
+	e.Res.ParentCoordStops += inheritParentCoords(feed.Stops)
+	if opts.BBox {
+		e.Res.BBoxes = append(e.Res.BBoxes, feedBBox(e.FeedPath, feed))
+	}
+	e.distMode = opts.DistMode
+	if e.distMode == "utm" {
+		var minZone, maxZone int
+		if e.distMode, minZone, maxZone = utmDistMode(feed.Stops, opts.SkipNullCoords); minZone != maxZone && opts.Log != nil {
+			fmt.Fprintf(opts.Log, "Feed '%s' spans UTM zones %d to %d, falling back to haversine distances\n", e.FeedPath, minZone, maxZone)
+		}
+	}
+	e.shpCache = newShapeCache(e.distMode)
+	e.shpCache.global = opts.GlobalCache
+	e.shpCache.hashPrec = opts.HashPrecision
+	e.snapsCache = make(map[snapKey][]StopSnap)
+	e.prefetched = make(map[snapKey]bool)
+	e.coverages = make(map[coverageKey]float64)
+	e.distRanges = make(map[*gtfs.Shape][2]float32)
+	e.autoDist = 0
+	e.svcDays = make(map[*gtfs.Service]int)
+	e.classes = make(map[string]TripClass)
+	e.stopWorst = make(map[*gtfs.Stop]WorstStop)
+
+	e.Res.Feeds += 1
+	if len(feed.Shapes) > 0 {
+		e.Res.FeedsWithShapes += 1
+	}
+
+	trips := make([]*gtfs.Trip, 0, len(feed.Trips))
+	for _, trip := range feed.Trips {
+		if !opts.matches(trip) {
+			continue
+		}
+		// before sampling, so that the sample only contains evaluated trips
+		if len(trip.StopTimes) < opts.MinStops {
+			e.Res.FewStopTrips += 1
+			continue
+		}
+		trips = append(trips, trip)
+	}
+
+	// with a filter, only the shapes of the matching trips are checked
+	var filtered map[*gtfs.Shape]bool
+	if len(opts.Routes) > 0 || len(opts.Trips) > 0 {
+		filtered = make(map[*gtfs.Shape]bool)
+		for _, trip := range trips {
+			if trip.Shape != nil {
+				filtered[trip.Shape] = true
+			}
+		}
+	}
+
+	if filtered != nil {
+		e.Res.Shapes += len(filtered)
+	} else {
+		e.Res.Shapes += len(feed.Shapes)
+	}
+	for _, trip := range trips {
+		if trip.Shape != nil {
+			e.Res.ShapedTrips += 1
+		}
+	}
+
+	for _, shp := range feed.Shapes {
+		if filtered != nil && !filtered[shp] {
+			continue
+		}
+
+		if !hasOrderedSeq(shp) {
+			e.Res.BadSeq += 1
+			if opts.SortShapes {
+				sort.SliceStable(shp.Points, func(i, j int) bool { return shp.Points[i].Sequence < shp.Points[j].Sequence })
+			}
+		}
+
+		// before any projection or length of the shape is cached
+		if opts.DedupPoints {
+			if n := dedupPoints(shp, e.Opts.Epsilon); n > 0 {
+				e.Res.DupPointShapes += 1
+				e.Res.DupPoints += n
+			}
+		} else if n := dupPoints(shp, e.Opts.Epsilon); n > 0 {
+			e.Res.DupPointShapes += 1
+			e.Res.DupPoints += n
+		}
+
+		if opts.SelfIntersect && selfIntersects(e.shpCache.projected(shp), e.shpCache.grid(shp)) {
+			e.Res.NumSelfInters += 1
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Self-intersecting shape '%s' in '%s'\n", shp.Id, e.FeedPath)
+			}
+		}
+		if opts.LowMemory {
+			e.shpCache.evict(shp)
+		}
+
+		if opts.CheckDistTraveled {
+			if min, max, dec, ok := shapeDistRange(shp); ok {
+				e.distRanges[shp] = [2]float32{min, max}
+				e.Res.DistTravShapes += 1
+				if dec {
+					e.Res.DistTravDecShapes += 1
+					if opts.Verbose {
+						fmt.Fprintf(opts.Log, "Shape '%s' in '%s': shape_dist_traveled decreases along the shape\n", shp.Id, e.FeedPath)
+					}
+				}
+			}
+		}
+
+		// summed over the feed's shapes, not its trips, to count shared shapes once
+		if opts.ShapeLength {
+			e.Res.ShapeLength += shapeLength(shp, e.distMode)
+		}
+
+		if !opts.Stats && opts.MaxDensity <= 0 && opts.MinDensity <= 0 {
+			continue
+		}
+
+		if d, ok := pointDensity(shp, e.distMode); ok {
+			e.Res.Densities = append(e.Res.Densities, d)
+			if opts.MaxDensity > 0 && d > opts.MaxDensity {
+				e.Res.NumOverDense += 1
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Over-dense shape '%s' in '%s': %.2f points per km\n", shp.Id, e.FeedPath, d)
+				}
+			}
+			if opts.MinDensity > 0 && d < opts.MinDensity {
+				e.Res.NumUnderDense += 1
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Under-dense shape '%s' in '%s': %.2f points per km\n", shp.Id, e.FeedPath, d)
+				}
+			}
+		}
+	}
+
+	if opts.FindDupShapes {
+		e.findDupShapes(feed, filtered)
+	}
+
+	if opts.MinStopSimilarity > 0 {
+		e.findDivergentStops(trips)
+	}
+
+	savedEvals := 0
+
+	var rng *rand.Rand
+	if opts.Sample > 0 && opts.Sample < 1 {
+		// fixed trip order, so that the sample only depends on the seed
+		sort.Slice(trips, func(i, j int) bool { return trips[i].Id < trips[j].Id })
+		rng = rand.New(rand.NewSource(opts.Seed))
+	}
+
+	var medians map[int16]float64
+	if opts.MinLengthRatio > 0 {
+		medians = e.medianShapeLengths(trips)
+	}
+
+	if opts.AutoDist {
+		e.autoDist = e.autoMaxDist(trips)
+		e.Res.AutoDists = append(e.Res.AutoDists, e.autoDist)
+		if opts.Log != nil {
+			fmt.Fprintf(opts.Log, "Auto-calibrated max distance for '%s': %s\n", e.FeedPath, fmtDist(e.autoDist, opts.Units))
+		}
+	}
+
+	var jsonl *json.Encoder
+	if opts.Jsonl != nil {
+		jsonl = json.NewEncoder(opts.Jsonl)
+	}
+
+	var unsampled map[*gtfs.Trip]bool
+	if opts.LowMemory {
+		// drawn in the original order, so that the sample does not change
+		if rng != nil {
+			unsampled = make(map[*gtfs.Trip]bool)
+			for _, trip := range trips {
+				if rng.Float64() >= opts.Sample {
+					unsampled[trip] = true
+				}
+			}
+			rng = nil
+		}
+		sort.SliceStable(trips, func(i, j int) bool {
+			a, b := trips[i].Shape, trips[j].Shape
+			if a == nil || b == nil {
+				return a == nil && b != nil
+			}
+			return a.Id < b.Id
+		})
+	}
+
+	var prevShape *gtfs.Shape
+
+	for i, trip := range trips {
+		if opts.LowMemory && trip.Shape != prevShape {
+			if prevShape != nil {
+				e.shpCache.evict(prevShape)
+				if !opts.AutoDist {
+					e.snapsCache = make(map[snapKey][]StopSnap)
+					e.coverages = make(map[coverageKey]float64)
+				}
+			}
+			prevShape = trip.Shape
+		}
+
+		if opts.Progress != nil && (i+1)%PROGRESS_TRIPS == 0 {
+			fmt.Fprintf(opts.Progress, "  %s: %d/%d trips\n", e.FeedPath, i+1, len(trips))
+		}
+
+		if e.Ctx != nil && i%1000 == 0 && e.Ctx.Err() != nil {
+			e.Res.Canceled = true
+			return
+		}
+
+		e.Res.AllTrips += 1
+		if (rng != nil && rng.Float64() >= opts.Sample) || unsampled[trip] {
+			continue
+		}
+
+		te := e.evaluateTrip(trip)
+		trip = te.Trip
+
+		e.Res.NullStops += te.NullStops
+		if te.NullTrip {
+			e.Res.NullTrips += 1
+			continue
+		}
+
+		weight := 0.0
+		if opts.WeightByService {
+			if _, ok := e.svcDays[trip.Service]; !ok {
+				e.svcDays[trip.Service] = serviceDays(trip.Service)
+			}
+			weight = float64(e.svcDays[trip.Service]) * tripsPerDay(trip)
+			e.Res.Weighted["all"] += weight
+		}
+
+		if trip.Shape != nil && crossesAntimeridian(trip.Shape) {
+			e.Res.Antimeridian += 1
+		}
+
+		// independent of the class, stop-to-stop placeholders are often degenerate
+		if opts.Stats && trip.Shape != nil && len(trip.Shape.Points) > 0 && len(trip.StopTimes) > 0 {
+			e.Res.PointRatios = append(e.Res.PointRatios, float64(len(trip.Shape.Points))/float64(len(trip.StopTimes)))
+			if len(trip.Shape.Points) == len(trip.StopTimes) {
+				e.Res.PointRatioOne += 1
+			}
+		}
+
+		if r, ok := e.distRanges[trip.Shape]; ok && trip.Shape != nil {
+			outside, dec := checkStopDists(trip, r[0], r[1])
+			e.Res.DistTravTrips += 1
+			e.Res.DistTravOutside += outside
+			if dec {
+				e.Res.DistTravDecTrips += 1
+			}
+			if opts.Verbose && (outside > 0 || dec) {
+				fmt.Fprintf(opts.Log, "Trip '%s' (route '%s') in '%s': %d stop times with shape_dist_traveled outside of [%g, %g]", trip.Id, routeId(trip), e.FeedPath, outside, r[0], r[1])
+				if dec {
+					fmt.Fprintf(opts.Log, ", shape_dist_traveled decreases between stops")
+				}
+				fmt.Fprintln(opts.Log)
+			}
+		}
+
+		if opts.PlaceholderRatio > 0 && len(trip.StopTimes) > 2 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+			if n := distinctFootPoints(te.Snaps, opts.Epsilon); float64(n) < opts.PlaceholderRatio*float64(len(trip.StopTimes)) {
+				e.Res.Placeholder += 1
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Placeholder trip '%s' (route '%s') in '%s': its %d stops snap to only %d distinct positions along the shape\n", trip.Id, routeId(trip), e.FeedPath, len(trip.StopTimes), n)
+				}
+			}
+		}
+
+		if te.Impossible {
+			e.Res.Impossible += 1
+			if opts.Verbose {
+				cum := e.shpCache.cumLengths(trip.Shape)
+				fmt.Fprintf(opts.Log, "Impossible trip '%s' (route '%s') in '%s': shape is %s long, its terminal stops are %s apart\n", trip.Id, routeId(trip), e.FeedPath, fmtDist(cum[len(cum)-1], opts.Units), fmtDist(te.StopSpan, opts.Units))
+			}
+		}
+
+		if te.OutOfOrder > 0 {
+			e.Res.OutOfOrder += 1
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Out-of-order trip '%s' (route '%s') in '%s': stop '%s' snaps to the shape before its predecessor\n", trip.Id, routeId(trip), e.FeedPath, trip.StopTimes[te.OutOfOrder].Stop.Id)
+			}
+		}
+		if medians != nil && trip.Shape != nil && te.Class != CLASS_NO_SHAPE && te.Class != CLASS_EMPTY_SHAPE && te.Class != CLASS_MALFORMED && te.Class != CLASS_DEGENERATE {
+			cum := e.shpCache.cumLengths(trip.Shape)
+			if med := medians[routeType(trip)]; cum[len(cum)-1] < opts.MinLengthRatio*med {
+				e.Res.ShortTrips += 1
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Short trip '%s' (route '%s') in '%s': shape is %s long, the median of its route type is %s\n", trip.Id, routeId(trip), e.FeedPath, fmtDist(cum[len(cum)-1], opts.Units), fmtDist(med, opts.Units))
+				}
+			}
+		}
+
+		if te.BearingIdx > 0 {
+			e.Res.BadBearing += 1
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Misdirected trip '%s' (route '%s') in '%s': direction towards stop '%s' differs by %.2f degrees from the shape\n", trip.Id, routeId(trip), e.FeedPath, trip.StopTimes[te.BearingIdx].Stop.Id, te.BearingDiff)
+			}
+		}
+
+		if te.StartGap > 0 || te.EndGap > 0 {
+			e.Res.Truncated += 1
+			for _, gap := range []float64{te.StartGap, te.EndGap} {
+				if gap > 0 {
+					e.Res.TruncatedEnds += 1
+					e.Res.TruncatedGaps += gap
+				}
+			}
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Truncated trip '%s' (route '%s') in '%s': shape ends %s before the first and %s before the last stop\n", trip.Id, routeId(trip), e.FeedPath, fmtDist(te.StartGap, opts.Units), fmtDist(te.EndGap, opts.Units))
+			}
+		}
+
+		if opts.MaxTail > 0 && (te.StartTail > opts.MaxTail || te.EndTail > opts.MaxTail) {
+			e.Res.TailTrips += 1
+			for _, tail := range []float64{te.StartTail, te.EndTail} {
+				if tail > opts.MaxTail {
+					e.Res.Tails = append(e.Res.Tails, tail)
+				}
+			}
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Tailed trip '%s' (route '%s') in '%s': shape runs %s before the first and %s after the last stop\n", trip.Id, routeId(trip), e.FeedPath, fmtDist(te.StartTail, opts.Units), fmtDist(te.EndTail, opts.Units))
+			}
+		}
+
+		e.Res.NonStops += te.NonStops
+
+		if te.Reused {
+			savedEvals += 1
+		}
+
+		if te.HasDetour {
+			e.Res.Detours = append(e.Res.Detours, te.Detour)
+			if te.Detour > opts.MaxDetour {
+				e.Res.NumDetour += 1
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Detouring trip '%s' (route '%s') in '%s': shape is %.2f times longer than the direct distance between its terminal stops\n", trip.Id, routeId(trip), e.FeedPath, te.Detour)
+				}
+			}
+		}
+
+		strayShape := te.HasOutsideBBox && te.OutsideBBox > opts.MaxOutsideBBox
+		if strayShape {
+			e.Res.OutsideBBoxTrips += 1
+			e.Res.OutsideBBoxFracs = append(e.Res.OutsideBBoxFracs, te.OutsideBBox)
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Stray shape for trip '%s' (route '%s') in '%s': %.2f %% of its shape points lie outside the bounding box of its stops\n", trip.Id, routeId(trip), e.FeedPath, te.OutsideBBox*100)
+			}
+		}
+
+		if jsonl != nil {
+			rec := TripResult{Feed: e.FeedPath, TripId: trip.Id, Class: te.Class}
+			if strayShape {
+				f := te.OutsideBBox
+				rec.OutsideBBox = &f
+			}
+			if te.WorstIdx >= 0 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+				d := te.WorstDist
+				rec.WorstDist = &d
+			}
+			if err := jsonl.Encode(rec); err != nil && opts.Log != nil {
+				fmt.Fprintln(opts.Log, "Error while writing JSON lines:", err)
+				jsonl = nil
+			}
+		}
+
+		if opts.Csv && te.Dists != nil {
+			for i, st := range trip.StopTimes {
+				e.Res.CsvRows = append(e.Res.CsvRows, []string{e.FeedPath, trip.Id, st.Stop.Id, strconv.Itoa(st.Sequence), strconv.FormatFloat(toUnit(te.Dists[i], opts.Units), 'f', unitPrec(opts.Units), 64)})
+			}
+		}
+
+		// trips without stop times have no worst stop
+		if opts.Top > 0 && te.WorstIdx >= 0 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+			e.Res.Top = append(e.Res.Top, SuspiciousTrip{Feed: e.FeedPath, TripId: trip.Id, RouteId: routeId(trip), StopId: trip.StopTimes[te.WorstIdx].Stop.Id, Dist: te.WorstDist})
+		}
+
+		if opts.WorstStops > 0 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+			for i, st := range trip.StopTimes {
+				if w, ok := e.stopWorst[st.Stop]; !ok || te.Dists[i] > w.Dist {
+					e.stopWorst[st.Stop] = WorstStop{Feed: e.FeedPath, StopId: st.Stop.Id, StopName: st.Stop.Name, Lat: float64(st.Stop.Lat), Lon: float64(st.Stop.Lon), Dist: te.Dists[i], TripId: trip.Id}
+				}
+			}
+		}
+
+		if opts.Coverage && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+			if c, ok := e.coverage(trip, te.MaxDist); ok {
+				e.Res.Coverages = append(e.Res.Coverages, c)
+			}
+		}
+
+		if te.DegReason == "" && (opts.Stats || opts.Histogram != nil) {
+			e.Res.StopDists = append(e.Res.StopDists, te.Dists...)
+		}
+
+		if opts.MaxDistFrac > 0 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+			e.Res.FracMaxDists = append(e.Res.FracMaxDists, te.StopMaxDists...)
+		}
+
+		if te.DegReason == "" && opts.Offsets {
+			for _, s := range te.Snaps {
+				if s.Seg <= 0 {
+					continue
+				}
+				e.Res.CrossOffsets = append(e.Res.CrossOffsets, s.Cross)
+				e.Res.AlongOffsets = append(e.Res.AlongOffsets, s.Along)
+				if s.Along > 0 && ((s.Seg == 1 && s.T == 0) || (s.Seg == len(trip.Shape.Points)-1 && s.T == 1)) {
+					e.Res.BeyondEnds += 1
+				}
+			}
+		}
+
+		e.count(trip, te.Class, weight)
+
+		// filtered trips are debugged one by one, so report each of them
+		if filtered != nil {
+			fmt.Fprintf(opts.Log, "Trip '%s' (route '%s') in '%s': %s", trip.Id, routeId(trip), e.FeedPath, te.Class)
+			if te.Class == CLASS_DEGENERATE {
+				fmt.Fprintf(opts.Log, " (%s)", te.DegReason)
+			} else if te.WorstIdx >= 0 && (te.Class == CLASS_OK || te.Class == CLASS_BORDERLINE || te.Class == CLASS_SUSPICIOUS) {
+				fmt.Fprintf(opts.Log, ", worst stop '%s' is %s from the shape", trip.StopTimes[te.WorstIdx].Stop.Id, fmtDist(te.WorstDist, opts.Units))
+			}
+			fmt.Fprintln(opts.Log)
+		}
+
+		if opts.WriteGtfs != "" {
+			e.classes[trip.Id] = te.Class
+		}
+		if opts.KeepClasses {
+			e.Res.Classes[trip.Id] = te.Class
+		}
+
+		switch te.Class {
+		case CLASS_DEGENERATE:
+			e.Res.DegReasons[te.DegReason] += 1
+		case CLASS_REVERSED:
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Reversed trip '%s' (route '%s') in '%s': shape runs in the opposite direction\n", trip.Id, routeId(trip), e.FeedPath)
+			}
+		case CLASS_SUSPICIOUS:
+			st := SuspiciousTrip{Feed: e.FeedPath, TripId: trip.Id, RouteId: routeId(trip), StopId: trip.StopTimes[te.WorstIdx].Stop.Id, Dist: te.WorstDist}
+			if opts.WorstTrips > 0 {
+				e.Res.Worst = append(e.Res.Worst, st)
+			}
+			impact, impactStops := 0.0, 0
+			if opts.StopWeights != nil {
+				for i, d := range te.Dists {
+					if d > te.StopMaxDists[i] {
+						impactStops += 1
+						impact += opts.StopWeights[trip.StopTimes[i].Stop.Id]
+					}
+				}
+				e.Res.ImpactStops += impactStops
+				e.Res.Impact += impact
+			}
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Suspicious trip '%s' (route '%s') in '%s': worst stop '%s' is %s from the shape", st.TripId, st.RouteId, st.Feed, st.StopId, fmtDist(st.Dist, opts.Units))
+				if opts.StopWeights != nil {
+					fmt.Fprintf(opts.Log, ", %d stops too distant with a weight of %.2f", impactStops, impact)
+				}
+				fmt.Fprintln(opts.Log)
+			}
+			if opts.GeoJson {
+				e.Res.Features = append(e.Res.Features, suspiciousFeatures(e.FeedPath, trip, te.Dists, te.StopMaxDists, opts.Units)...)
+			}
+		}
+	}
+
+	e.Res.SavedEvals += savedEvals
+
+	if opts.OrphanStops {
+		e.countOrphanStops(feed)
+	}
+
+	if opts.Simplify > 0 {
+		e.simplifyShapes(feed)
+	}
+
+	if p := e.shpCache.peakSize(); p > e.Res.PeakCachedShapes {
+		e.Res.PeakCachedShapes = p
+	}
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Cached the projections of at most %d shapes at once for '%s'\n", e.Res.PeakCachedShapes, e.FeedPath)
+	}
+
+	sort.SliceStable(e.Res.Worst, func(i, j int) bool { return e.Res.Worst[i].Dist > e.Res.Worst[j].Dist })
+	if len(e.Res.Worst) > opts.WorstTrips {
+		e.Res.Worst = e.Res.Worst[:opts.WorstTrips]
+	}
+
+	e.Res.Top = topTrips(e.Res.Top, opts.Top)
+
+	if opts.WorstStops > 0 {
+		e.Res.WorstStops = worstStops(e.stopWorst, opts.WorstStops)
+	}
+
+	if opts.Verbose && savedEvals > 0 {
+		fmt.Fprintf(opts.Log, "Reused stop-to-shape distances for %d trips with identical shape and stops in '%s'\n", savedEvals, e.FeedPath)
+	}
+}
+
+// counts the stops of the feed that are farther than MaxDist from every shape
+// used by a trip
+func (e *Evaluator) countOrphanStops(feed *gtfsparser.Feed) {
+	// each shape serves a stop within the largest max distance of its trips,
+	// which differ with MaxDistByType
+	used := make(map[*gtfs.Shape]int)
+	shps := make([]*gtfs.Shape, 0)
+	maxDists := make([]float64, 0)
+	for _, trip := range feed.Trips {
+		if trip.Shape == nil {
+			continue
+		}
+		i, ok := used[trip.Shape]
+		if !ok {
+			i = len(shps)
+			used[trip.Shape] = i
+			shps = append(shps, trip.Shape)
+			maxDists = append(maxDists, 0)
+		}
+		maxDists[i] = math.Max(maxDists[i], e.maxDistFor(trip))
+	}
+
+	for _, st := range feed.Stops {
+		// stations and entrances are not served by trips themselves
+		if st.Location_type != 0 || (e.Opts.SkipNullCoords && isNullStop(st)) {
+			continue
+		}
+		if isOrphanStop(st, shps, maxDists, e.distMode, e.shpCache) {
+			e.Res.NumOrphanStops += 1
+			if e.Opts.Verbose {
+				fmt.Fprintf(e.Opts.Log, "Orphan stop '%s' in '%s': farther from every shape than the max distance of the shape's trips\n", st.Id, e.FeedPath)
+			}
+		}
+	}
+}
+
+// distinct stop ids of the trip
+func stopSet(trip *gtfs.Trip) map[string]bool {
+	ret := make(map[string]bool, len(trip.StopTimes))
+	for _, st := range trip.StopTimes {
+		ret[st.Stop.Id] = true
+	}
+	return ret
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	n := 0
+	for id := range a {
+		if b[id] {
+			n += 1
+		}
+	}
+	return float64(n) / float64(len(a)+len(b)-n)
+}
+
+// Compares the stops of the trips sharing a shape with those of the shape's
+// most common stop pattern and counts the trips below MinStopSimilarity, at
+// least one of them probably references the wrong shape.
+func (e *Evaluator) findDivergentStops(trips []*gtfs.Trip) {
+	byShape := make(map[*gtfs.Shape][]*gtfs.Trip)
+	for _, trip := range trips {
+		if trip.Shape != nil {
+			byShape[trip.Shape] = append(byShape[trip.Shape], trip)
+		}
+	}
+
+	shapes := make([]*gtfs.Shape, 0)
+	for shp, ts := range byShape {
+		if len(ts) > 1 {
+			shapes = append(shapes, shp)
+		}
+	}
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Id < shapes[j].Id })
+
+	for _, shp := range shapes {
+		ts := byShape[shp]
+		sort.Slice(ts, func(i, j int) bool { return ts[i].Id < ts[j].Id })
+
+		// the most common stop sequence, the one of the first trip on ties
+		keys := make([]string, len(ts))
+		counts := make(map[string]int)
+		ref := 0
+		for i, trip := range ts {
+			ids := make([]string, 0, len(trip.StopTimes))
+			for _, st := range trip.StopTimes {
+				ids = append(ids, st.Stop.Id)
+			}
+			keys[i] = strings.Join(ids, "\x00")
+			counts[keys[i]] += 1
+			if counts[keys[i]] > counts[keys[ref]] {
+				ref = i
+			}
+		}
+
+		refSet := stopSet(ts[ref])
+		divergent := make([]string, 0)
+		minSim := 1.0
+		for i, trip := range ts {
+			if keys[i] == keys[ref] {
+				continue
+			}
+			if sim := jaccard(refSet, stopSet(trip)); sim < e.Opts.MinStopSimilarity {
+				divergent = append(divergent, "'"+trip.Id+"'")
+				minSim = math.Min(minSim, sim)
+			}
+		}
+
+		if len(divergent) == 0 {
+			continue
+		}
+
+		e.Res.DivergentShapes += 1
+		e.Res.DivergentTrips += len(divergent)
+		if e.Opts.Verbose {
+			fmt.Fprintf(e.Opts.Log, "Shape '%s' in '%s': stops of trips %s differ from those of trip '%s', Jaccard similarity down to %.2f\n", shp.Id, e.FeedPath, strings.Join(divergent, ", "), ts[ref].Id, minSim)
+		}
+	}
+}
+
+// Groups the feed's shapes (only those in filtered, if not nil) with the same
+// hash at HashPrecision whose points are all within Epsilon of the first shape
+// of their group and counts the groups of more than one shape, which could all
+// be replaced by the first one.
+func (e *Evaluator) findDupShapes(feed *gtfsparser.Feed, filtered map[*gtfs.Shape]bool) {
+	buckets := make(map[uint64][]*gtfs.Shape)
+	for _, shp := range feed.Shapes {
+		if (filtered != nil && !filtered[shp]) || len(shp.Points) == 0 {
+			continue
+		}
+		h := shapeHash(shp, "", e.Opts.HashPrecision)
+		buckets[h] = append(buckets[h], shp)
+	}
+
+	dups := make([][]*gtfs.Shape, 0)
+	for _, b := range buckets {
+		if len(b) < 2 {
+			continue
+		}
+		sort.Slice(b, func(i, j int) bool { return b[i].Id < b[j].Id })
+
+		groups := make([][]*gtfs.Shape, 0)
+		for _, shp := range b {
+			found := false
+			for i, g := range groups {
+				if sameGeometry(g[0], shp, e.Opts.Epsilon) {
+					groups[i] = append(g, shp)
+					found = true
+					break
+				}
+			}
+			if !found {
+				groups = append(groups, []*gtfs.Shape{shp})
+			}
+		}
+
+		for _, g := range groups {
+			if len(g) > 1 {
+				dups = append(dups, g)
+			}
+		}
+	}
+
+	for _, g := range dups {
+		e.Res.DupShapeGroups += 1
+		e.Res.DupShapes += len(g) - 1
+		e.Res.DupShapePoints += (len(g) - 1) * len(g[0].Points)
+	}
+
+	if !e.Opts.Verbose {
+		return
+	}
+
+	sort.Slice(dups, func(i, j int) bool { return dups[i][0].Id < dups[j][0].Id })
+	for _, g := range dups {
+		ids := make([]string, len(g))
+		for i, shp := range g {
+			ids[i] = "'" + shp.Id + "'"
+		}
+		fmt.Fprintf(e.Opts.Log, "Duplicate shapes in '%s' with %d points each: %s\n", e.FeedPath, len(g[0].Points), strings.Join(ids, ", "))
+	}
+}
+
+// Simplifies each shape used by a trip and counts the points that could be
+// dropped without moving any stop that is within its max distance of the
+// original shape beyond it. The feed itself is not modified.
+func (e *Evaluator) simplifyShapes(feed *gtfsparser.Feed) {
+	// per shape, the smallest max distance of each stop over all trips
+	stops := make(map[*gtfs.Shape]map[*gtfs.Stop]float64)
+	for _, trip := range feed.Trips {
+		if trip.Shape == nil || len(trip.Shape.Points) < 2 {
+			continue
+		}
+		if _, ok := stops[trip.Shape]; !ok {
+			stops[trip.Shape] = make(map[*gtfs.Stop]float64)
+		}
+		maxDist := e.maxDistFor(trip)
+		for _, st := range trip.StopTimes {
+			if d, ok := stops[trip.Shape][st.Stop]; !ok || maxDist < d {
+				stops[trip.Shape][st.Stop] = maxDist
+			}
+		}
+	}
+
+	for shp, shpStops := range stops {
+		proj := e.shpCache.projected(shp)
+		pts, simpProj := simplifiedPoints(shp, proj, e.Opts.Simplify, e.distMode)
+
+		var g *segGrid
+		if len(simpProj)-1 >= GRID_MIN_SEGS {
+			g = newSegGrid(simpProj)
+		}
+
+		ok := true
+		for st, maxDist := range shpStops {
+			if nearestSegDist(st, pts, simpProj, g, e.distMode) > maxDist && nearestSegDist(st, shp.Points, proj, e.shpCache.grid(shp), e.distMode) <= maxDist {
+				ok = false
+				break
+			}
+		}
+
+		e.Res.SimplifyPoints += len(shp.Points)
+		if ok {
+			e.Res.SimplifyDropped += len(shp.Points) - len(pts)
+		} else {
+			e.Res.SimplifyRejects += 1
+		}
+	}
+}
+
+// Simplifies the shapes of the last evaluated feed with the Simplify tolerance
+// and writes the feed to path. Shapes whose simplification would turn an OK
+// or borderline trip into a worse one are kept unsimplified, their number is
+// returned.
+func (e *Evaluator) writeSimplified(feed *gtfsparser.Feed, path string) (int, error) {
+	reverted := 0
+
+	if e.Opts.Simplify > 0 {
+		orig := make(map[*gtfs.Shape]gtfs.ShapePoints)
+		for _, shp := range feed.Shapes {
+			if len(shp.Points) < 3 {
+				continue
+			}
+			orig[shp] = shp.Points
+			shp.Points, _ = simplifiedPoints(shp, e.shpCache.projected(shp), e.Opts.Simplify, e.distMode)
+		}
+
+		// classify again on the simplified shapes, with fresh caches
+		check := NewEvaluator(e.Opts)
+		check.feed = feed
+		check.distMode = e.distMode
+		check.shpCache = newShapeCache(e.distMode)
+		check.autoDist = e.autoDist
+
+		for _, trip := range feed.Trips {
+			before := e.classes[trip.Id]
+			if trip.Shape == nil || (before != CLASS_OK && before != CLASS_BORDERLINE) {
+				continue
+			}
+			pts, ok := orig[trip.Shape]
+			if !ok {
+				continue
+			}
+			if after := check.Classify(trip); after != CLASS_OK && after != before {
+				trip.Shape.Points = pts
+				delete(orig, trip.Shape)
+				reverted += 1
+			}
+		}
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return reverted, err
+	}
+
+	w := gtfswriter.Writer{ZipCompressionLevel: 9, Sorted: true}
+	return reverted, w.Write(feed, path)
+}
+
+// the n trips of trips with the most distant worst stops, most distant first
+// and ties ordered by feed and trip id, so that the selection does not depend
+// on the order trips and feeds were evaluated in
+func topTrips(trips []SuspiciousTrip, n int) []SuspiciousTrip {
+	sort.Slice(trips, func(i, j int) bool {
+		if trips[i].Dist != trips[j].Dist {
+			return trips[i].Dist > trips[j].Dist
+		}
+		if trips[i].Feed != trips[j].Feed {
+			return trips[i].Feed < trips[j].Feed
+		}
+		return trips[i].TripId < trips[j].TripId
+	})
+	if len(trips) > n {
+		trips = trips[:n]
+	}
+	return trips
+}
+
+// options with the defaults of the gtfs-shp-eval command
+func DefaultOptions() Options {
+	return Options{
+		MaxDist:        250,
+		DistMode:       "webmerc",
+		CollinearTol:   1,
+		MinLenRatio:    0.5,
+		AutoDistPct:    95,
+		AutoDistMargin: 25,
+		SortShapes:     true,
+		Epsilon:        0.5,
+		HashPrecision:  6,
+		Sample:         1,
+		Seed:           1,
+		Timeout:        5 * time.Minute,
+		ParseOpts:      gtfsparser.ParseOptions{UseDefValueOnError: true, DropErroneous: true, CheckNullCoordinates: false, EmptyStringRepl: "", ZipFix: true},
+		Units:          "m",
+		Log:            io.Discard,
+	}
+}
+
+// Evaluates a feed parsed by the caller and returns its summary, including
+// the breakdowns by route type and agency. Shape points may be sorted and
+// deduplicated in place, depending on opts. Outputs that are written to
+// files by the command, like Csv, GeoJson and WriteGtfs, are ignored.
+func EvaluateFeed(feed *gtfsparser.Feed, opts Options) (sum Summary, err error) {
+	if feed == nil {
+		return sum, fmt.Errorf("no feed given")
+	}
+
+	if opts.DistMode != "webmerc" && opts.DistMode != "haversine" && opts.DistMode != "utm" && opts.DistMode != "enu" {
+		return sum, fmt.Errorf("unknown distance mode '%s'", opts.DistMode)
+	}
+
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+	opts.Csv, opts.GeoJson, opts.WriteGtfs = false, false, ""
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("evaluation failed: %v", r)
+		}
+	}()
+
+	e := NewEvaluator(opts)
+	e.EvaluateFeed(feed)
+
+	return NewSummary(e.Res, opts, true, true), nil
+}
+
+// parses and evaluates the feed at gtfsPath, which may also be a http(s) URL
+func EvaluatePath(ctx context.Context, gtfsPath string, opts Options) (res FeedResult) {
+	res = NewFeedResult()
+	res.Path = gtfsPath
+
+	if opts.Log == nil {
+		opts.Log = io.Discard
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			res.Panic = r
+		}
+	}()
+
+	if ctx.Err() != nil {
+		res.Canceled = true
+		return
+	}
+
+	loc_feed := gtfsparser.NewFeed()
+	loc_feed.SetParseOpts(opts.ParseOpts)
+
+	parsePath := gtfsPath
+
+	if IsUrl(gtfsPath) {
+		if parsePath, res.Err = downloadFeed(ctx, gtfsPath, opts.Timeout); res.Err != nil {
+			return
+		}
+		defer os.Remove(parsePath)
+	} else if gtfsPath == STDIN_PATH {
+		if parsePath, res.Err = copyToTemp(os.Stdin); res.Err != nil {
+			return
+		}
+		defer os.Remove(parsePath)
+	}
+
+	if isTarGz(gtfsPath) {
+		var tmp string
+		if parsePath, tmp, res.Err = extractTarGz(parsePath); res.Err != nil {
+			return
+		}
+		defer os.RemoveAll(tmp)
+	}
+
+	// the parser itself can not be canceled
+	start := time.Now()
+	res.Err = loc_feed.Parse(parsePath)
+	parseTime := time.Since(start)
+	if res.Err != nil || ctx.Err() != nil {
+		res.Canceled = res.Err == nil
+		return
+	}
+
+	e := NewEvaluator(opts)
+	e.FeedPath = gtfsPath
+	e.Ctx = ctx
+	start = time.Now()
+	e.EvaluateFeed(loc_feed)
+	evalTime := time.Since(start)
+
+	if e.Res.Canceled {
+		res.Canceled = true
+		return
+	}
+
+	res = e.Res
+	res.Path = gtfsPath
+	res.ParseTime, res.EvalTime = parseTime, evalTime
+
+	if opts.WriteGtfs != "" {
+		out := filepath.Join(opts.WriteGtfs, feedName(gtfsPath))
+		n, err := e.writeSimplified(loc_feed, out)
+		if res.WriteErr = err; err == nil && opts.Progress != nil {
+			fmt.Fprintf(opts.Progress, "Wrote feed '%s' to '%s', %d shapes kept unsimplified to preserve stop coverage\n", gtfsPath, out, n)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,296 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/patrickbr/gtfsparser"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parses the feed in path with gtfsparser and evaluates it with opts
+func evalFixture(t *testing.T, path string, opts Options) FeedResult {
+	t.Helper()
+
+	feed := gtfsparser.NewFeed()
+	feed.SetParseOpts(opts.ParseOpts)
+	if err := feed.Parse(path); err != nil {
+		t.Fatalf("could not parse '%s': %v", path, err)
+	}
+
+	e := NewEvaluator(opts)
+	e.FeedPath = path
+	e.Ctx = context.Background()
+	e.EvaluateFeed(feed)
+	return e.Res
+}
+
+// copy of the test feed base in a temporary directory, with the given files
+// replaced
+func fixtureWith(t *testing.T, base string, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	src := filepath.Join("..", "testdata", base)
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range entries {
+		data, err := os.ReadFile(filepath.Join(src, ent.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, ok := files[ent.Name()]; ok {
+			data = []byte(content)
+		}
+		if err := os.WriteFile(filepath.Join(dir, ent.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFixtureClasses(t *testing.T) {
+	tests := []struct {
+		feed string
+		want Counts
+	}{
+		{"clean", Counts{Trips: 1, Ok: 1}},
+		{"distant", Counts{Trips: 1, Suspicious: 1}},
+		{"degenerate", Counts{Trips: 1, Degenerate: 1}},
+		{"noshape", Counts{Trips: 1, NoShape: 1}},
+		{"reversed", Counts{Trips: 1, Reversed: 1}},
+		{"empty", Counts{Trips: 1, EmptyShape: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.feed, func(t *testing.T) {
+			res := evalFixture(t, filepath.Join("..", "testdata", tt.feed), DefaultOptions())
+			if res.Counts != tt.want {
+				t.Errorf("got %+v, want %+v", res.Counts, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinglePointShape(t *testing.T) {
+	path := fixtureWith(t, "clean", map[string]string{"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\ns1,48.000000,7.850000,1\n"})
+
+	res := evalFixture(t, path, DefaultOptions())
+	if want := (Counts{Trips: 1, Malformed: 1}); res.Counts != want {
+		t.Errorf("got %+v, want %+v", res.Counts, want)
+	}
+}
+
+func TestEmptyShapeGeometry(t *testing.T) {
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Jsonl = &buf
+
+	// all points of the shape lack a latitude and are dropped on parsing
+	res := evalFixture(t, filepath.Join("..", "testdata", "empty"), opts)
+	if res.EmptyShape != 1 || res.NoShape != 0 || res.Suspicious != 0 {
+		t.Errorf("got %+v, want a single trip with an empty shape", res.Counts)
+	}
+
+	var rec TripResult
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Class != CLASS_EMPTY_SHAPE || rec.WorstDist != nil {
+		t.Errorf("got trip %+v, want class %s without a worst distance", rec, CLASS_EMPTY_SHAPE)
+	}
+}
+
+// Stops left out by SkipNullCoords must also be left out when the trips are
+// classified again on the simplified shapes.
+func TestWriteSimplifiedSkipsNullStops(t *testing.T) {
+	path := fixtureWith(t, "clean", map[string]string{
+		"stops.txt":      "stop_id,stop_name,stop_lat,stop_lon\nst0,Stop 0,48.000000,7.800000\nst1,Stop 1,48.000000,7.850000\nst2,Stop 2,48.000000,7.900000\nnull,Null Island,0,0\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\nt1,08:00:00,08:00:00,st0,1\nt1,08:01:00,08:01:00,st1,2\nt1,08:01:30,08:01:30,null,3\nt1,08:02:00,08:02:00,st2,4\n",
+	})
+
+	opts := DefaultOptions()
+	opts.SkipNullCoords = true
+	opts.Simplify = 20
+	opts.WriteGtfs = t.TempDir()
+
+	feed := gtfsparser.NewFeed()
+	feed.SetParseOpts(opts.ParseOpts)
+	if err := feed.Parse(path); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEvaluator(opts)
+	e.FeedPath = path
+	e.EvaluateFeed(feed)
+	if e.Res.Ok != 1 {
+		t.Fatalf("got %+v, want an OK trip", e.Res.Counts)
+	}
+
+	reverted, err := e.writeSimplified(feed, filepath.Join(opts.WriteGtfs, "clean"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pts := len(feed.Shapes["s1"].Points); reverted != 0 || pts >= 11 {
+		t.Errorf("got %d reverted shapes and %d shape points, want the simplified shape", reverted, pts)
+	}
+}
+
+// The middle stop of the distant feed is about 1.1 km off the shape, the
+// others lie on it.
+func TestAutoDist(t *testing.T) {
+	tests := []struct {
+		pct  float64
+		want Counts
+	}{
+		{100, Counts{Trips: 1, Ok: 1}},
+		{50, Counts{Trips: 1, Suspicious: 1}},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.AutoDist = true
+		opts.AutoDistPct = tt.pct
+		opts.Top = 1
+
+		res := evalFixture(t, filepath.Join("..", "testdata", "distant"), opts)
+		if res.Counts != tt.want {
+			t.Errorf("p%.0f: got %+v, want %+v", tt.pct, res.Counts, tt.want)
+		}
+
+		// the percentile of the stop distances plus the margin
+		want := 25.0
+		if tt.pct == 100 {
+			want = res.Top[0].Dist + 25
+		}
+		if len(res.AutoDists) != 1 || math.Abs(res.AutoDists[0]-want) > 0.01 {
+			t.Errorf("p%.0f: got auto-calibrated max distances %v, want [%.2f]", tt.pct, res.AutoDists, want)
+		}
+	}
+}
+
+// The stops of the distant feed are almost 4 km apart, half of that covers
+// the middle stop about 1.1 km off the shape unless capped below.
+func TestMaxDistFrac(t *testing.T) {
+	tests := []struct {
+		cap  float64
+		want Counts
+	}{
+		{3000, Counts{Trips: 1, Ok: 1}},
+		{1000, Counts{Trips: 1, Suspicious: 1}},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.MaxDistFrac = 0.5
+		opts.MaxDistFracCap = tt.cap
+
+		if res := evalFixture(t, filepath.Join("..", "testdata", "distant"), opts); res.Counts != tt.want {
+			t.Errorf("cap %.0f m: got %+v, want %+v", tt.cap, res.Counts, tt.want)
+		}
+	}
+}
+
+// Stop times at stops at 0,0 would make the trip suspicious, unless they are
+// skipped. A trip with no other stop is not evaluated at all.
+func TestSkipNullCoords(t *testing.T) {
+	path := fixtureWith(t, "clean", map[string]string{
+		"stops.txt":      "stop_id,stop_name,stop_lat,stop_lon\nst0,Stop 0,48.000000,7.800000\nst1,Stop 1,48.000000,7.850000\nst2,Stop 2,48.000000,7.900000\nnull,Null Island,0,0\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\nt1,08:00:00,08:00:00,st0,1\nt1,08:01:00,08:01:00,st1,2\nt1,08:01:30,08:01:30,null,3\nt1,08:02:00,08:02:00,st2,4\nt2,09:00:00,09:00:00,null,1\n",
+		"trips.txt":      "route_id,service_id,trip_id,shape_id\nR,S,t1,s1\nR,S,t2,s1\n",
+	})
+
+	if res := evalFixture(t, path, DefaultOptions()); res.Suspicious != 1 {
+		t.Errorf("got %+v without skipping, want a suspicious trip", res.Counts)
+	}
+
+	opts := DefaultOptions()
+	opts.SkipNullCoords = true
+	res := evalFixture(t, path, opts)
+	if res.Ok != 1 || res.Suspicious != 0 || res.NullStops != 2 || res.NullTrips != 1 {
+		t.Errorf("got %+v with %d skipped stop times and %d skipped trips, want 1 OK trip, 2 and 1", res.Counts, res.NullStops, res.NullTrips)
+	}
+}
+
+// Only stops served by trips count as orphans, not stations.
+func TestOrphanStops(t *testing.T) {
+	path := fixtureWith(t, "clean", map[string]string{
+		"stops.txt": "stop_id,stop_name,stop_lat,stop_lon,location_type\nst0,Stop 0,48.000000,7.800000,0\nst1,Stop 1,48.000000,7.850000,0\nst2,Stop 2,48.000000,7.900000,0\nnear,Near,48.001000,7.850000,0\nfar,Far,48.010000,7.850000,0\nstation,Far Station,48.020000,7.850000,1\n",
+	})
+
+	tests := []struct {
+		maxDist float64
+		want    int
+	}{
+		{250, 1},
+		{50, 2},
+		{5000, 0},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.MaxDist = tt.maxDist
+		opts.OrphanStops = true
+
+		if res := evalFixture(t, path, opts); res.NumOrphanStops != tt.want {
+			t.Errorf("max distance %.0f m: got %d orphan stops, want %d", tt.maxDist, res.NumOrphanStops, tt.want)
+		}
+	}
+}
+
+// '-' reads a zipped feed from stdin
+func TestEvaluateStdin(t *testing.T) {
+	zipped := filepath.Join(t.TempDir(), "clean.zip")
+	f, err := os.Create(zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	src := filepath.Join("..", "testdata", "clean")
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range entries {
+		data, err := os.ReadFile(filepath.Join(src, ent.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.Create(ent.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	in, err := os.Open(zipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	stdin := os.Stdin
+	os.Stdin = in
+	defer func() { os.Stdin = stdin }()
+
+	res := EvaluatePath(context.Background(), STDIN_PATH, DefaultOptions())
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if want := (Counts{Trips: 1, Ok: 1}); res.Counts != want {
+		t.Errorf("got %+v, want %+v", res.Counts, want)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// feed path reading a zipped feed from stdin
+var STDIN_PATH string = "-"
+
+func IsUrl(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// copies r into a temporary ZIP file and returns its path
+func copyToTemp(r io.Reader) (string, error) {
+	f, err := os.CreateTemp("", "gtfs-shp-eval-*.zip")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// downloads the feed at url into a temporary file and returns its path
+func downloadFeed(ctx context.Context, url string, timeout time.Duration) (string, error) {
+	client := http.Client{Timeout: timeout}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download '%s': %s", url, resp.Status)
+	}
+
+	return copyToTemp(resp.Body)
+}
+
+// true if the path or URL names a gzipped tarball
+func isTarGz(path string) bool {
+	if IsUrl(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	path = strings.ToLower(path)
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// Extracts the gzipped tarball into a new temporary directory. Returns the
+// directory to parse, which is the single top-level folder of the tarball if
+// the feed is nested in one, and the temporary directory to remove afterwards.
+func extractTarGz(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", "", err
+	}
+	defer gz.Close()
+
+	tmp, err := os.MkdirTemp("", "gtfs-shp-eval-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", "", err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			os.RemoveAll(tmp)
+			return "", "", fmt.Errorf("invalid path '%s' in '%s'", hdr.Name, path)
+		}
+		target := filepath.Join(tmp, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = extractTarFile(tr, target)
+		}
+
+		if err != nil {
+			os.RemoveAll(tmp)
+			return "", "", err
+		}
+	}
+
+	dir := tmp
+	if entries, err := os.ReadDir(tmp); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		dir = filepath.Join(tmp, entries[0].Name())
+	}
+
+	return dir, tmp, nil
+}
+
+func extractTarFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func IsGtfsLocation(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	if !info.IsDir() {
+		return strings.ToLower(filepath.Ext(path)) == ".zip" || isTarGz(path)
+	}
+
+	for _, f := range []string{"stops.txt", "trips.txt"} {
+		if fi, err := os.Stat(filepath.Join(path, f)); err != nil || fi.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// true if the path matches any of the filepath.Match patterns, those without
+// a separator are matched against its last element only
+func matchesGlob(path string, globs []string) bool {
+	for _, g := range globs {
+		target := filepath.Base(path)
+		if strings.Contains(g, "/") {
+			target = filepath.ToSlash(path)
+		}
+		if ok, _ := filepath.Match(g, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reads one feed path or URL per line, skipping empty lines and # comments
+func ReadFeedList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ret = append(ret, line)
+	}
+
+	return ret, nil
+}
+
+// Returns the feeds below the folders, in walk order. STDIN_PATH and URLs are
+// kept as they are. Paths matching an exclude pattern are skipped, and if
+// include patterns are given, feeds must match one of them
+func FindFeeds(folders []string, include, exclude []string) []string {
+	ret := make([]string, 0)
+
+	for _, folder := range folders {
+		if folder == STDIN_PATH || IsUrl(folder) {
+			ret = append(ret, folder)
+			continue
+		}
+
+		filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if matchesGlob(path, exclude) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !IsGtfsLocation(path) {
+				return nil
+			}
+			if len(include) > 0 && !matchesGlob(path, include) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ret = append(ret, path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+
+	return ret
+}
+
+// Drops repeated feeds, keeping the first occurence. Local paths are compared
+// after filepath.Clean, as feeds may be both listed and found below a folder
+func UniqueFeeds(paths []string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(paths))
+	for _, p := range paths {
+		key := p
+		if !IsUrl(p) && p != STDIN_PATH {
+			key = filepath.Clean(p)
+		}
+		if !seen[key] {
+			seen[key] = true
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
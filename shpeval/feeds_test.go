@@ -0,0 +1,107 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// a .tar.gz archive in a temporary directory with a file per name
+func tarGz(t *testing.T, names ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "feed.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("x"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestExtractTarGz(t *testing.T) {
+	// a single top-level folder is the feed
+	dir, tmp, err := extractTarGz(tarGz(t, "feed/stops.txt", "feed/trips.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if dir != filepath.Join(tmp, "feed") {
+		t.Errorf("got feed folder '%s', want '%s'", dir, filepath.Join(tmp, "feed"))
+	}
+	if !IsGtfsLocation(dir) {
+		t.Errorf("extracted folder '%s' is no feed", dir)
+	}
+}
+
+func TestExtractTarGzTraversal(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "feed/../../evil.txt", "/evil.txt"} {
+		archive := tarGz(t, "stops.txt", name)
+		if _, _, err := extractTarGz(archive); err == nil {
+			t.Errorf("extracted an archive with the entry '%s', want an error", name)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(archive), "evil.txt")); err == nil {
+			t.Errorf("entry '%s' was written outside of the extracted folder", name)
+		}
+	}
+}
+
+func TestFindFeeds(t *testing.T) {
+	root := filepath.Join("..", "testdata")
+	feed := func(name string) string { return filepath.Join(root, name) }
+
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+	}{
+		{"all", nil, nil, []string{feed("clean"), feed("degenerate"), feed("distant"), feed("empty"), feed("noshape"), feed("reversed")}},
+		{"exclude", nil, []string{"d*"}, []string{feed("clean"), feed("empty"), feed("noshape"), feed("reversed")}},
+		{"include", []string{"*e*d"}, nil, []string{feed("reversed")}},
+		{"include and exclude", []string{"d*"}, []string{"distant"}, []string{feed("degenerate")}},
+		{"path pattern", []string{"*/testdata/clean"}, nil, []string{feed("clean")}},
+	}
+
+	for _, tt := range tests {
+		if got := FindFeeds([]string{root}, tt.include, tt.exclude); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// neither are searched
+	locs := []string{STDIN_PATH, "https://example.com/gtfs.zip"}
+	if got := FindFeeds(locs, []string{"none"}, nil); !reflect.DeepEqual(got, locs) {
+		t.Errorf("got %v, want %v", got, locs)
+	}
+}
+
+func TestUniqueFeeds(t *testing.T) {
+	got := UniqueFeeds([]string{"a/feed", "a/./feed/", "b", "https://example.com/x/../gtfs.zip", "https://example.com/gtfs.zip", "b"})
+	want := []string{"a/feed", "b", "https://example.com/x/../gtfs.zip", "https://example.com/gtfs.zip"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,851 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"github.com/patrickbr/gtfsparser"
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var DEG_TO_RAD float64 = 0.017453292519943295769236907684886127134428718885417254560
+var EARTH_RADIUS float64 = 6371000.0
+
+var GRID_MIN_SEGS int = 32
+
+// units distances can be reported in, with their length in meters. All
+// distances are computed in meters.
+var UNITS = map[string]float64{"m": 1, "km": 1000, "ft": 0.3048}
+
+// distance d in meters converted to unit, unknown units are meters
+func toUnit(d float64, unit string) float64 {
+	if f, ok := UNITS[unit]; ok {
+		return d / f
+	}
+	return d
+}
+
+// decimal places that keep distances in unit at about centimeter precision
+func unitPrec(unit string) int {
+	if unit == "km" {
+		return 5
+	}
+	return 2
+}
+
+// the unit distances are converted to by toUnit
+func unitName(unit string) string {
+	if _, ok := UNITS[unit]; !ok {
+		return "m"
+	}
+	return unit
+}
+
+// distance d in meters formatted in unit, e.g. "12.34 m"
+func fmtDist(d float64, unit string) string {
+	return strconv.FormatFloat(toUnit(d, unit), 'f', unitPrec(unit), 64) + " " + unitName(unit)
+}
+
+type shapeCache struct {
+	distMode string
+	// shared across feeds, may be nil
+	global *ProjCache
+	// decimal places of the coordinates hashed for global
+	hashPrec int
+	proj     sync.Map
+	cumLen   sync.Map
+	grids    sync.Map
+	// shapes with any cached value, and the max number of them at once
+	held sync.Map
+	size int64
+	peak int64
+}
+
+func newShapeCache(distMode string) *shapeCache {
+	return &shapeCache{distMode: distMode}
+}
+
+// counts the shape as held, if it was not yet
+func (c *shapeCache) hold(shp *gtfs.Shape) {
+	if _, ok := c.held.LoadOrStore(shp, true); ok {
+		return
+	}
+	n := atomic.AddInt64(&c.size, 1)
+	for {
+		p := atomic.LoadInt64(&c.peak)
+		if n <= p || atomic.CompareAndSwapInt64(&c.peak, p, n) {
+			return
+		}
+	}
+}
+
+// drops everything cached for the shape, it is recomputed on the next access
+func (c *shapeCache) evict(shp *gtfs.Shape) {
+	if _, ok := c.held.LoadAndDelete(shp); !ok {
+		return
+	}
+	c.proj.Delete(shp)
+	c.cumLen.Delete(shp)
+	c.grids.Delete(shp)
+	atomic.AddInt64(&c.size, -1)
+}
+
+// max number of shapes held at once
+func (c *shapeCache) peakSize() int {
+	return int(atomic.LoadInt64(&c.peak))
+}
+
+// projections of the shape's points according to distMode, computed on first access
+func (c *shapeCache) projected(shp *gtfs.Shape) [][]float64 {
+	if pts, ok := c.proj.Load(shp); ok {
+		return pts.([][]float64)
+	}
+
+	var key uint64
+	if c.global != nil {
+		key = shapeHash(shp, c.distMode, c.hashPrec)
+		if pts := c.global.get(key, len(shp.Points)); pts != nil {
+			c.hold(shp)
+			c.proj.Store(shp, pts)
+			return pts
+		}
+	}
+
+	// longitudes are unwrapped, so that shapes crossing the antimeridian stay continuous
+	pts := make([][]float64, 0, len(shp.Points))
+	lon := 0.0
+	for i, p := range shp.Points {
+		if i == 0 {
+			lon = float64(p.Lon)
+		} else {
+			lon = unwrapLon(float64(p.Lon), lon)
+		}
+		x, y := project(float64(p.Lat), lon, c.distMode)
+		pts = append(pts, []float64{x, y})
+	}
+
+	if c.global != nil {
+		c.global.put(key, pts)
+	}
+
+	c.hold(shp)
+	c.proj.Store(shp, pts)
+	return pts
+}
+
+// FNV-1a hash of the coordinates of the shape's points, rounded to the given
+// number of decimal places, so that shapes differing only in the last bits of
+// their coordinates share it. Projections differ between UTM zones, so
+// distMode is hashed as well.
+func shapeHash(shp *gtfs.Shape, distMode string, decimals int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(distMode))
+	f := math.Pow(10, float64(decimals))
+	buf := make([]byte, 16)
+	for _, p := range shp.Points {
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(int64(math.Round(float64(p.Lat)*f))))
+		binary.LittleEndian.PutUint64(buf[8:16], uint64(int64(math.Round(float64(p.Lon)*f))))
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+// extends the bounding box by the point, NaN coordinates are ignored.
+// The centroid holds the coordinate sums until finish.
+func (b *BBox) add(lat, lon float32) {
+	if lat != lat || lon != lon {
+		return
+	}
+	if b.Points == 0 || float64(lat) < b.MinLat {
+		b.MinLat = float64(lat)
+	}
+	if b.Points == 0 || float64(lat) > b.MaxLat {
+		b.MaxLat = float64(lat)
+	}
+	if b.Points == 0 || float64(lon) < b.MinLon {
+		b.MinLon = float64(lon)
+	}
+	if b.Points == 0 || float64(lon) > b.MaxLon {
+		b.MaxLon = float64(lon)
+	}
+	b.CentroidLat += float64(lat)
+	b.CentroidLon += float64(lon)
+	b.Points += 1
+}
+
+func (b *BBox) finish() {
+	if b.Points > 0 {
+		b.CentroidLat /= float64(b.Points)
+		b.CentroidLon /= float64(b.Points)
+	}
+}
+
+// bounding boxes of the feed's stops and shape points
+func feedBBox(feedPath string, feed *gtfsparser.Feed) FeedBBox {
+	ret := FeedBBox{Feed: feedPath}
+	for _, st := range feed.Stops {
+		ret.Stops.add(st.Lat, st.Lon)
+	}
+	ret.Stops.finish()
+
+	shapes := BBox{}
+	for _, shp := range feed.Shapes {
+		for _, p := range shp.Points {
+			shapes.add(p.Lat, p.Lon)
+		}
+	}
+	if shapes.Points > 0 {
+		shapes.finish()
+		ret.Shapes = &shapes
+	}
+	return ret
+}
+
+// true if the points a and b, given as latitude and longitude, are at most
+// eps meters apart. All checks for equal coordinates go through this.
+func coordsEqual(a, b [2]float64, eps float64) bool {
+	if a == b {
+		return true
+	}
+	return haversineDist(a[0], a[1], b[0], b[1]) <= eps
+}
+
+// latitude and longitude of the shape point, as compared by coordsEqual
+func pointCoords(p gtfs.ShapePoint) [2]float64 {
+	return [2]float64{float64(p.Lat), float64(p.Lon)}
+}
+
+// true if both shapes have the same number of points and all of their
+// points are pairwise within eps meters
+func sameGeometry(a, b *gtfs.Shape, eps float64) bool {
+	if len(a.Points) != len(b.Points) {
+		return false
+	}
+	for i := range a.Points {
+		if !coordsEqual(pointCoords(a.Points[i]), pointCoords(b.Points[i]), eps) {
+			return false
+		}
+	}
+	return true
+}
+
+// LRU cache of projected shape points, keyed by the hash of their
+// coordinates, shared by the evaluation of all feeds
+type ProjCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[uint64]*list.Element
+	lru     *list.List
+	hits    int
+	misses  int
+}
+
+type projCacheEntry struct {
+	key uint64
+	pts [][]float64
+}
+
+func NewProjCache(size int) *ProjCache {
+	return &ProjCache{size: size, entries: make(map[uint64]*list.Element), lru: list.New()}
+}
+
+// the cached projection, or nil if there is none with n points under key
+func (c *ProjCache) get(key uint64, n int) [][]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok && len(el.Value.(*projCacheEntry).pts) == n {
+		c.lru.MoveToFront(el)
+		c.hits += 1
+		return el.Value.(*projCacheEntry).pts
+	}
+
+	c.misses += 1
+	return nil
+}
+
+func (c *ProjCache) Stats() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *ProjCache) put(key uint64, pts [][]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*projCacheEntry).pts = pts
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&projCacheEntry{key, pts})
+
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*projCacheEntry).key)
+	}
+}
+
+// length in meters of the shape up to each of its points
+func (c *shapeCache) cumLengths(shp *gtfs.Shape) []float64 {
+	if l, ok := c.cumLen.Load(shp); ok {
+		return l.([]float64)
+	}
+
+	l := make([]float64, len(shp.Points))
+	for i := 1; i < len(shp.Points); i++ {
+		l[i] = l[i-1] + geoDist(shp.Points[i-1].Lat, shp.Points[i-1].Lon, shp.Points[i].Lat, shp.Points[i].Lon, c.distMode)
+	}
+
+	c.hold(shp)
+	c.cumLen.Store(shp, l)
+	return l
+}
+
+// uniform grid index over the projected segments of a shape
+func (c *shapeCache) grid(shp *gtfs.Shape) *segGrid {
+	if g, ok := c.grids.Load(shp); ok {
+		return g.(*segGrid)
+	}
+
+	g := newSegGrid(c.projected(shp))
+	c.hold(shp)
+	c.grids.Store(shp, g)
+	return g
+}
+
+type segGrid struct {
+	minX, minY float64
+	cell       float64
+	nx, ny     int
+	cells      [][]int
+}
+
+// Builds a grid over the segments (i-1, i) of the projected points, with
+// roughly one segment per cell. Each cell holds the indices i of all segments
+// whose bounding box intersects it.
+func newSegGrid(proj [][]float64) *segGrid {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+
+	for _, p := range proj {
+		minX, minY = math.Min(minX, p[0]), math.Min(minY, p[1])
+		maxX, maxY = math.Max(maxX, p[0]), math.Max(maxY, p[1])
+	}
+
+	nsegs := len(proj) - 1
+	cell := math.Max(math.Max(maxX-minX, maxY-minY)/math.Sqrt(float64(nsegs)), 1)
+
+	g := &segGrid{minX: minX, minY: minY, cell: cell}
+	g.nx = int((maxX-minX)/cell) + 1
+	g.ny = int((maxY-minY)/cell) + 1
+	g.cells = make([][]int, g.nx*g.ny)
+
+	for i := 1; i < len(proj); i++ {
+		x0, x1 := g.col(math.Min(proj[i-1][0], proj[i][0])), g.col(math.Max(proj[i-1][0], proj[i][0]))
+		y0, y1 := g.row(math.Min(proj[i-1][1], proj[i][1])), g.row(math.Max(proj[i-1][1], proj[i][1]))
+		for cx := x0; cx <= x1; cx++ {
+			for cy := y0; cy <= y1; cy++ {
+				g.cells[cy*g.nx+cx] = append(g.cells[cy*g.nx+cx], i)
+			}
+		}
+	}
+
+	return g
+}
+
+func (g *segGrid) col(x float64) int {
+	return int(math.Max(0, math.Min(float64(g.nx-1), math.Floor((x-g.minX)/g.cell))))
+}
+
+func (g *segGrid) row(y float64) int {
+	return int(math.Max(0, math.Min(float64(g.ny-1), math.Floor((y-g.minY)/g.cell))))
+}
+
+// Indices of all segments whose projected distance to (x, y) is at most
+// slack times the distance of the nearest segment. The cells are searched in
+// rings around (x, y) until no unvisited cell can contain a closer segment,
+// starting at the first ring that touches the grid if (x, y) lies outside it.
+func (g *segGrid) candidates(proj [][]float64, x, y, slack float64) []int {
+	cx := int(math.Floor((x - g.minX) / g.cell))
+	cy := int(math.Floor((y - g.minY) / g.cell))
+
+	// rings closer than minR and farther than maxR do not touch the grid
+	minR := 0
+	for _, d := range []int{-cx, cx - (g.nx - 1), -cy, cy - (g.ny - 1)} {
+		if d > minR {
+			minR = d
+		}
+	}
+	maxR := 0
+	for _, d := range []int{cx, g.nx - 1 - cx, cy, g.ny - 1 - cy} {
+		if d < 0 {
+			d = -d
+		}
+		if d > maxR {
+			maxR = d
+		}
+	}
+
+	seen := make(map[int]float64)
+	best := math.Inf(1)
+
+	visit := func(i, j int) {
+		if i < 0 || j < 0 || i >= g.nx || j >= g.ny {
+			return
+		}
+		for _, seg := range g.cells[j*g.nx+i] {
+			if _, ok := seen[seg]; ok {
+				continue
+			}
+			d := perpDist(x, y, proj[seg-1][0], proj[seg-1][1], proj[seg][0], proj[seg][1])
+			seen[seg] = d
+			best = math.Min(best, d)
+		}
+	}
+
+	for r := minR; r <= maxR; r++ {
+		// only the edges of the ring, clipped to the grid
+		i0, i1 := imax(cx-r, 0), imin(cx+r, g.nx-1)
+		for i := i0; i <= i1; i++ {
+			visit(i, cy-r)
+			if r > 0 {
+				visit(i, cy+r)
+			}
+		}
+		j0, j1 := imax(cy-r+1, 0), imin(cy+r-1, g.ny-1)
+		for j := j0; j <= j1; j++ {
+			visit(cx-r, j)
+			if r > 0 {
+				visit(cx+r, j)
+			}
+		}
+
+		if best*slack <= float64(r)*g.cell {
+			break
+		}
+	}
+
+	ret := make([]int, 0, 1)
+	for seg, d := range seen {
+		if d <= best*slack {
+			ret = append(ret, seg)
+		}
+	}
+
+	return ret
+}
+
+// Calls visit for each cell of size cell that the segment (a, b) passes
+// through, from the cell of a to that of b. Cells only touched at a corner
+// may be missed, callers needing them must widen the visited cells.
+func walkCells(a, b []float64, cell float64, visit func(cx, cy int)) {
+	cx, cy := int(math.Floor(a[0]/cell)), int(math.Floor(a[1]/cell))
+	ex, ey := int(math.Floor(b[0]/cell)), int(math.Floor(b[1]/cell))
+
+	// segment parameter t of the next cell border crossed on each axis, and
+	// the change of t between two borders
+	step := func(c int, from, to float64) (int, float64, float64) {
+		d := to - from
+		switch {
+		case d > 0:
+			return 1, (float64(c+1)*cell - from) / d, cell / d
+		case d < 0:
+			return -1, (float64(c)*cell - from) / d, -cell / d
+		}
+		return 0, math.Inf(1), math.Inf(1)
+	}
+	sx, tx, dtx := step(cx, a[0], b[0])
+	sy, ty, dty := step(cy, a[1], b[1])
+
+	visit(cx, cy)
+
+	// each step moves one cell closer to that of b
+	n := (ex-cx)*sx + (ey-cy)*sy
+	for k := 0; k < n; k++ {
+		if (tx < ty && cx != ex) || cy == ey {
+			cx += sx
+			tx += dtx
+		} else {
+			cy += sy
+			ty += dty
+		}
+		visit(cx, cy)
+	}
+}
+
+// Slack for candidates that keeps the segment nearest in meters to a point
+// at projected y among them. Web mercator distances are larger than metric
+// ones by a factor that grows with the latitude, so the projected distances
+// of two segments may be off by the ratio of the largest to the smallest
+// factor over the grid's latitudes and that of y. One percent more covers
+// the difference of haversine and enu distances to the corrected ones.
+func (g *segGrid) slack(y float64, distMode string) float64 {
+	if _, _, ok := utmZone(distMode); ok {
+		return 1.01
+	}
+
+	lo := webMercToLat(math.Min(y, g.minY))
+	hi := webMercToLat(math.Max(y, g.minY+float64(g.ny)*g.cell))
+
+	// the factor is smallest at the latitude closest to the equator
+	minLat := 0.0
+	if lo > 0 {
+		minLat = lo
+	} else if hi < 0 {
+		minLat = -hi
+	}
+	maxLat := math.Max(math.Abs(lo), math.Abs(hi))
+
+	return 1.01 * math.Cos(minLat*DEG_TO_RAD) / math.Cos(maxLat*DEG_TO_RAD)
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// twice the signed area of the triangle (a, b, c), positive if counter-clockwise
+func orientation(a, b, c []float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// true if the segments (a, b) and (c, d) properly cross, touching or
+// overlapping segments do not count
+func segsCross(a, b, c, d []float64) bool {
+	return orientation(a, b, c)*orientation(a, b, d) < 0 && orientation(c, d, a)*orientation(c, d, b) < 0
+}
+
+// true if any two non-adjacent segments of the projected points cross, only
+// segment pairs sharing a grid cell are tested
+func selfIntersects(proj [][]float64, g *segGrid) bool {
+	if len(proj) < 4 {
+		return false
+	}
+
+	for _, cell := range g.cells {
+		for a := 0; a < len(cell); a++ {
+			for b := a + 1; b < len(cell); b++ {
+				i, j := cell[a], cell[b]
+				if i-j <= 1 && j-i <= 1 {
+					continue
+				}
+				if segsCross(proj[i-1], proj[i], proj[j-1], proj[j]) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// lon shifted by a multiple of 360 degrees to lie within 180 degrees of ref
+func unwrapLon(lon float64, ref float64) float64 {
+	for lon-ref > 180 {
+		lon -= 360
+	}
+	for lon-ref < -180 {
+		lon += 360
+	}
+	return lon
+}
+
+// true if a segment of the shape crosses the antimeridian, assuming no
+// segment spans more than 180 degrees of longitude
+func crossesAntimeridian(shp *gtfs.Shape) bool {
+	for i := 1; i < len(shp.Points); i++ {
+		if math.Abs(float64(shp.Points[i].Lon-shp.Points[i-1].Lon)) > 180 {
+			return true
+		}
+	}
+	return false
+}
+
+// projection of a point into the plane distMode measures in, UTM if distMode
+// is a resolved zone like 'utm32n', web mercator otherwise
+func project(lat, lon float64, distMode string) (float64, float64) {
+	if zone, south, ok := utmZone(distMode); ok {
+		return latLngToUtm(lat, lon, zone, south)
+	}
+	return latLngToWebMerc(lat, lon)
+}
+
+// distance in meters from the projected point p to the segment a-b
+func projPerpDist(px, py, lax, lay, lbx, lby float64, distMode string) float64 {
+	if _, _, ok := utmZone(distMode); ok {
+		return perpDist(px, py, lax, lay, lbx, lby)
+	}
+	return webMercPerpDist(px, py, lax, lay, lbx, lby)
+}
+
+// factor by which projected distances near lat are larger than metric ones
+func projScale(lat float32, distMode string) float64 {
+	if _, _, ok := utmZone(distMode); ok {
+		return 1
+	}
+	return 1 / math.Cos(float64(lat)*DEG_TO_RAD)
+}
+
+// zone and hemisphere of a resolved UTM distance mode like 'utm32n'
+func utmZone(distMode string) (int, bool, bool) {
+	if len(distMode) < 5 || distMode[:3] != "utm" {
+		return 0, false, false
+	}
+	zone, err := strconv.Atoi(distMode[3 : len(distMode)-1])
+	if err != nil || zone < 1 || zone > 60 {
+		return 0, false, false
+	}
+	return zone, distMode[len(distMode)-1] == 's', true
+}
+
+// UTM zone containing the longitude
+func lonToUtmZone(lon float64) int {
+	return int(math.Floor((lon+180)/6))%60 + 1
+}
+
+// Resolves the 'utm' distance mode for a feed to the zone of its mean stop
+// longitude. If the stops span more than one zone, 'haversine' is returned.
+// Also returns the zones of the westernmost and easternmost stop.
+func utmDistMode(stops map[string]*gtfs.Stop, skipNull bool) (string, int, int) {
+	minZone, maxZone := 0, 0
+	lat, lon := 0.0, 0.0
+	n := 0
+
+	for _, st := range stops {
+		if skipNull && isNullStop(st) {
+			continue
+		}
+		n += 1
+		z := lonToUtmZone(float64(st.Lon))
+		if minZone == 0 || z < minZone {
+			minZone = z
+		}
+		if z > maxZone {
+			maxZone = z
+		}
+		lat += float64(st.Lat)
+		lon += float64(st.Lon)
+	}
+
+	if minZone != maxZone {
+		return "haversine", minZone, maxZone
+	}
+
+	if n == 0 {
+		return "haversine", 0, 0
+	}
+
+	hemi := "n"
+	if lat/float64(n) < 0 {
+		hemi = "s"
+	}
+
+	return fmt.Sprintf("utm%d%s", lonToUtmZone(lon/float64(n)), hemi), minZone, maxZone
+}
+
+// Transverse mercator projection of a point into the UTM zone on the WGS84
+// ellipsoid, in meters (Snyder's series). Distances in the plane are off by
+// less than 0.1 % within the zone.
+func latLngToUtm(lat, lon float64, zone int, south bool) (float64, float64) {
+	const a = 6378137.0
+	const f = 1 / 298.257223563
+	const k0 = 0.9996
+
+	e2 := f * (2 - f)
+	ep2 := e2 / (1 - e2)
+
+	phi := lat * DEG_TO_RAD
+	lam0 := float64((zone-1)*6-180+3) * DEG_TO_RAD
+
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := a / math.Sqrt(1-e2*sin*sin)
+	t := tan * tan
+	c := ep2 * cos * cos
+	A := cos * (lon*DEG_TO_RAD - lam0)
+
+	m := a * ((1-e2/4-3*e2*e2/64-5*e2*e2*e2/256)*phi -
+		(3*e2/8+3*e2*e2/32+45*e2*e2*e2/1024)*math.Sin(2*phi) +
+		(15*e2*e2/256+45*e2*e2*e2/1024)*math.Sin(4*phi) -
+		(35*e2*e2*e2/3072)*math.Sin(6*phi))
+
+	x := k0*n*(A+(1-t+c)*A*A*A/6+(5-18*t+t*t+72*c-58*ep2)*A*A*A*A*A/120) + 500000
+	y := k0 * (m + n*tan*(A*A/2+(5-t+9*c+4*c*c)*A*A*A*A/24+(61-58*t+t*t+600*c-330*ep2)*A*A*A*A*A*A/720))
+
+	if south {
+		y += 10000000
+	}
+
+	return x, y
+}
+
+// web mercator x and y in projected meters, computed entirely in float64
+func latLngToWebMerc(lat float64, lng float64) (float64, float64) {
+	x := 6378137.0 * lng * DEG_TO_RAD
+	a := lat * DEG_TO_RAD
+
+	y := 3189068.5 * math.Log((1.0+math.Sin(a))/(1.0-math.Sin(a)))
+	return x, y
+}
+
+// latitude in degrees of a web mercator y coordinate
+func webMercToLat(y float64) float64 {
+	return (2*math.Atan(math.Exp(y/6378137.0)) - math.Pi/2) / DEG_TO_RAD
+}
+
+// distance in meters from the web mercator point p to the segment a-b. The
+// projected distance to the foot point is scaled by the cosine of the mean
+// latitude of p and the foot point, so the correction follows the segment
+// instead of only the latitude of p.
+func webMercPerpDist(px, py, lax, lay, lbx, lby float64) float64 {
+	t := footParam(px, py, lax, lay, lbx, lby)
+	fx, fy := lax+t*(lbx-lax), lay+t*(lby-lay)
+	return dist(px, py, fx, fy) * math.Cos(webMercToLat((py+fy)/2)*DEG_TO_RAD)
+}
+
+func perpDist(px, py, lax, lay, lbx, lby float64) float64 {
+	d := dist(lax, lay, lbx, lby) * dist(lax, lay, lbx, lby)
+
+	if d == 0 {
+		return dist(px, py, lax, lay)
+	}
+	t := float64((px-lax)*(lbx-lax)+(py-lay)*(lby-lay)) / d
+	if t < 0 {
+		return dist(px, py, lax, lay)
+	} else if t > 1 {
+		return dist(px, py, lbx, lby)
+	}
+
+	return dist(px, py, lax+t*(lbx-lax), lay+t*(lby-lay))
+}
+
+// position of the foot point of p on the segment a-b, clamped to [0, 1]
+func footParam(px, py, lax, lay, lbx, lby float64) float64 {
+	return math.Max(0, math.Min(1, lineParam(px, py, lax, lay, lbx, lby)))
+}
+
+// position of the foot point of p on the line through a and b, 0 at a and 1
+// at b, outside of [0, 1] beyond the ends of the segment
+func lineParam(px, py, lax, lay, lbx, lby float64) float64 {
+	d := (lbx-lax)*(lbx-lax) + (lby-lay)*(lby-lay)
+
+	if d == 0 {
+		return 0
+	}
+
+	return ((px-lax)*(lbx-lax) + (py-lay)*(lby-lay)) / d
+}
+
+func dist(x1 float64, y1 float64, x2 float64, y2 float64) float64 {
+	return math.Sqrt(float64((x2-x1)*(x2-x1) + (y2-y1)*(y2-y1)))
+}
+
+func haversineDist(lat1, lon1, lat2, lon2 float64) float64 {
+	return haversineAngle(lat1, lon1, lat2, lon2) * EARTH_RADIUS
+}
+
+func haversineAngle(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := (lat2 - lat1) * DEG_TO_RAD
+	dLon := (lon2 - lon1) * DEG_TO_RAD
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*DEG_TO_RAD)*math.Cos(lat2*DEG_TO_RAD)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * DEG_TO_RAD
+	phi2 := lat2 * DEG_TO_RAD
+	dLon := (lon2 - lon1) * DEG_TO_RAD
+
+	return math.Atan2(math.Sin(dLon)*math.Cos(phi2), math.Cos(phi1)*math.Sin(phi2)-math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLon))
+}
+
+// great-circle distance in meters from point p to the segment a-b, using
+// the cross-track distance if the foot point lies on the segment and the
+// distance to the nearest endpoint otherwise
+func haversinePerpDist(plat, plon, alat, alon, blat, blon float64) float64 {
+	dab := haversineAngle(alat, alon, blat, blon)
+	dap := haversineAngle(alat, alon, plat, plon)
+
+	if dab == 0 {
+		return dap * EARTH_RADIUS
+	}
+
+	dTheta := bearing(alat, alon, plat, plon) - bearing(alat, alon, blat, blon)
+	xt := math.Asin(math.Sin(dap) * math.Sin(dTheta))
+	at := math.Atan(math.Tan(dap) * math.Cos(dTheta))
+
+	if at < 0 || math.Cos(dTheta) < 0 {
+		return dap * EARTH_RADIUS
+	} else if at > dab {
+		return haversineDist(plat, plon, blat, blon)
+	}
+
+	return math.Abs(xt) * EARTH_RADIUS
+}
+
+// East and north offset in meters of a point from the origin o, in the plane
+// tangent to the earth at o (orthographic projection of the sphere). Offsets
+// are exact in direction and, up to a few kilometers, in length.
+func latLngToEnu(lat, lon, olat, olon float64) (float64, float64) {
+	phi, phi0 := lat*DEG_TO_RAD, olat*DEG_TO_RAD
+	dLon := (lon - olon) * DEG_TO_RAD
+
+	e := EARTH_RADIUS * math.Cos(phi) * math.Sin(dLon)
+	n := EARTH_RADIUS * (math.Cos(phi0)*math.Sin(phi) - math.Sin(phi0)*math.Cos(phi)*math.Cos(dLon))
+	return e, n
+}
+
+// distance in meters from point p to the segment a-b, with the foot point
+// clamped to the segment in the plane tangent to the earth at p
+func enuPerpDist(plat, plon, alat, alon, blat, blon float64) float64 {
+	ax, ay := latLngToEnu(alat, alon, plat, plon)
+	bx, by := latLngToEnu(blat, blon, plat, plon)
+	return perpDist(0, 0, ax, ay, bx, by)
+}
+
+// distance in meters between two points, measured according to distMode
+func geoDist(lat1, lon1, lat2, lon2 float32, distMode string) float64 {
+	if distMode == "haversine" {
+		return haversineDist(float64(lat1), float64(lon1), float64(lat2), float64(lon2))
+	}
+
+	x1, y1 := project(float64(lat1), float64(lon1), distMode)
+	x2, y2 := project(float64(lat2), unwrapLon(float64(lon2), float64(lon1)), distMode)
+	return dist(x1, y1, x2, y2) / projScale((lat1+lat2)/2, distMode)
+}
+
+// distance in meters from point p to the segment a-b, measured according to distMode
+func geoPerpDist(plat, plon, alat, alon, blat, blon float32, distMode string) float64 {
+	if distMode == "haversine" {
+		return haversinePerpDist(float64(plat), float64(plon), float64(alat), float64(alon), float64(blat), float64(blon))
+	} else if distMode == "enu" {
+		return enuPerpDist(float64(plat), float64(plon), float64(alat), float64(alon), float64(blat), float64(blon))
+	}
+
+	px, py := project(float64(plat), float64(plon), distMode)
+	ax, ay := project(float64(alat), unwrapLon(float64(alon), float64(plon)), distMode)
+	bx, by := project(float64(blat), unwrapLon(float64(blon), float64(plon)), distMode)
+	return projPerpDist(px, py, ax, ay, bx, by, distMode)
+}
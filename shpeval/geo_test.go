@@ -0,0 +1,231 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"testing"
+)
+
+// a zigzag of n points with roughly 20 m long segments
+func zigzag(n int) [][]float64 {
+	proj := make([][]float64, n)
+	for i := range proj {
+		proj[i] = []float64{float64(i) * 20, float64(i%2) * 5}
+	}
+	return proj
+}
+
+func TestSegGridCandidates(t *testing.T) {
+	proj := zigzag(2000)
+	g := newSegGrid(proj)
+
+	// inside the grid, right of it, far outside and diagonally outside
+	for _, pt := range [][2]float64{{1010, 30}, {50000, 0}, {-3e6, 1e6}, {-5e5, -5e5}} {
+		best, bestSeg := math.Inf(1), 0
+		for i := 1; i < len(proj); i++ {
+			if d := perpDist(pt[0], pt[1], proj[i-1][0], proj[i-1][1], proj[i][0], proj[i][1]); d < best {
+				best, bestSeg = d, i
+			}
+		}
+
+		found := false
+		for _, seg := range g.candidates(proj, pt[0], pt[1], 1) {
+			if seg == bestSeg {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("candidates for (%v, %v) miss the nearest segment %d", pt[0], pt[1], bestSeg)
+		}
+	}
+}
+
+func BenchmarkSegGridCandidatesOutside(b *testing.B) {
+	proj := zigzag(2000)
+	g := newSegGrid(proj)
+
+	for i := 0; i < b.N; i++ {
+		g.candidates(proj, -3e6, 1e6, 1)
+	}
+}
+
+func TestWalkCells(t *testing.T) {
+	// diagonal, backwards, axis-parallel, through a corner and within a cell
+	for _, seg := range [][4]float64{{0.5, 0.5, 7.3, 3.9}, {9.9, -2.5, -4.1, 6.2}, {-3.5, 2.5, 6.5, 2.5}, {0.5, 0.5, 3.5, 3.5}, {0.2, 0.3, 0.7, 0.9}} {
+		a, b := []float64{seg[0], seg[1]}, []float64{seg[2], seg[3]}
+
+		visited := make(map[[2]int]bool)
+		walkCells(a, b, 1, func(cx, cy int) { visited[[2]int{cx, cy}] = true })
+
+		if !visited[[2]int{int(math.Floor(b[0])), int(math.Floor(b[1]))}] {
+			t.Errorf("walk along %v misses the cell of its end", seg)
+		}
+
+		// each cell the segment passes through is visited or next to one
+		for k := 0; k <= 1000; k++ {
+			f := float64(k) / 1000
+			c := [2]int{int(math.Floor(a[0] + f*(b[0]-a[0]))), int(math.Floor(a[1] + f*(b[1]-a[1])))}
+			near := false
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					near = near || visited[[2]int{c[0] + dx, c[1] + dy}]
+				}
+			}
+			if !near {
+				t.Errorf("walk along %v misses cell %v", seg, c)
+				break
+			}
+		}
+
+		if max := int(math.Abs(math.Floor(b[0])-math.Floor(a[0])) + math.Abs(math.Floor(b[1])-math.Floor(a[1])) + 1); len(visited) > max {
+			t.Errorf("walk along %v visits %d cells, want at most %d", seg, len(visited), max)
+		}
+	}
+}
+
+func TestSelfIntersects(t *testing.T) {
+	tests := []struct {
+		name string
+		proj [][]float64
+		want bool
+	}{
+		{"figure-eight", [][]float64{{0, 0}, {10, 10}, {10, 0}, {0, 10}, {0, 0}}, true},
+		{"closed loop", [][]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}, false},
+		{"touching segments", [][]float64{{0, 0}, {10, 0}, {10, 10}, {5, 0}}, false},
+		{"overlapping segments", [][]float64{{0, 0}, {10, 0}, {10, 10}, {10, 0}, {5, 0}}, false},
+		{"long zigzag", zigzag(2000), false},
+		{"zigzag crossing back", append(zigzag(2000), []float64{1000, -10}, []float64{1010, 20}), true},
+	}
+
+	for _, tt := range tests {
+		if got := selfIntersects(tt.proj, newSegGrid(tt.proj)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSegsCross(t *testing.T) {
+	a, b := []float64{0, 0}, []float64{10, 0}
+	tests := []struct {
+		name string
+		c, d []float64
+		want bool
+	}{
+		{"crossing", []float64{5, -5}, []float64{5, 5}, true},
+		{"end on the segment", []float64{5, 0}, []float64{5, 5}, false},
+		{"shared end point", []float64{10, 0}, []float64{10, 5}, false},
+		{"collinear overlap", []float64{5, 0}, []float64{15, 0}, false},
+		{"disjoint", []float64{5, 1}, []float64{5, 5}, false},
+	}
+
+	for _, tt := range tests {
+		if got := segsCross(a, b, tt.c, tt.d); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if got := segsCross(tt.c, tt.d, a, b); got != tt.want {
+			t.Errorf("%s, swapped: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// a point offset from (lat, lon) by dn meters north and de meters east
+func offset(lat, lon, dn, de float64) (float64, float64) {
+	return lat + dn/EARTH_RADIUS/DEG_TO_RAD, lon + de/(EARTH_RADIUS*math.Cos(lat*DEG_TO_RAD))/DEG_TO_RAD
+}
+
+func TestWebMercPerpDistHighLatitude(t *testing.T) {
+	for _, lat := range []float64{60, 70, 78} {
+		// east-west segments with the stop north of them, and a north-south
+		// segment spanning over a kilometer of latitude with the stop east of it
+		alat, alon := offset(lat, 10, -100, -500)
+		blat, blon := offset(lat, 10, -100, 500)
+		clat, clon := offset(lat, 10, -800, -150)
+		dlat, dlon := offset(lat, 10, 800, -150)
+
+		for _, seg := range [][4]float64{{alat, alon, blat, blon}, {clat, clon, dlat, dlon}} {
+			// both on the float32 coordinates of the parser
+			var s [4]float32
+			for i := range seg {
+				s[i] = float32(seg[i])
+			}
+			want := haversinePerpDist(lat, 10, float64(s[0]), float64(s[1]), float64(s[2]), float64(s[3]))
+			got := geoPerpDist(float32(lat), 10, s[0], s[1], s[2], s[3], "webmerc")
+			// web mercator uses the equatorial radius, haversine the mean one
+			if math.Abs(got-want) > 0.005*want {
+				t.Errorf("at %v degrees: web mercator distance %.3f m, haversine %.3f m", lat, got, want)
+			}
+		}
+	}
+}
+
+func TestAntimeridian(t *testing.T) {
+	shp := &gtfs.Shape{Id: "fiji", Points: gtfs.ShapePoints{{Lat: -17, Lon: 179.9, Sequence: 1}, {Lat: -17, Lon: -179.9, Sequence: 2}}}
+	want := haversineDist(-17, 179.9, -17, 180.1)
+
+	if !crossesAntimeridian(shp) {
+		t.Errorf("shape from 179.9 to -179.9 does not cross the antimeridian")
+	}
+
+	for _, distMode := range []string{"webmerc", "haversine", "enu"} {
+		if l := shapeLength(shp, distMode); math.Abs(l-want) > 0.005*want {
+			t.Errorf("%s: shape is %.0f m long, want %.0f m", distMode, l, want)
+		}
+		// a stop 100 m north of the seam, the great circle bows a few meters
+		// further south than the parallel
+		if d := geoPerpDist(-17+float32(100/EARTH_RADIUS/DEG_TO_RAD), 180, -17, 179.9, -17, -179.9, distMode); math.Abs(d-100) > 5 {
+			t.Errorf("%s: stop is %.2f m from the shape, want 100 m", distMode, d)
+		}
+	}
+}
+
+// the former float32 projection, for comparison
+func latLngToWebMerc32(lat float32, lng float32) (float64, float64) {
+	x := 6378137.0 * lng * float32(DEG_TO_RAD)
+	a := float64(lat * float32(DEG_TO_RAD))
+	y := float32(3189068.5 * math.Log((1.0+math.Sin(a))/(1.0-math.Sin(a))))
+	return float64(x), float64(y)
+}
+
+func TestLatLngToWebMercPrecision(t *testing.T) {
+	worst32 := 0.0
+	for _, p := range [][2]float64{{48.0, 7.85}, {-33.8688, 151.2093}, {64.1466, -21.9426}, {0.0001, 179.9999}} {
+		// the usual definition of the projection
+		wantX := 6378137.0 * p[1] * math.Pi / 180
+		wantY := 6378137.0 * math.Log(math.Tan(math.Pi/4+p[0]*math.Pi/360))
+
+		x, y := latLngToWebMerc(p[0], p[1])
+		if e := dist(x, y, wantX, wantY); e > 1e-6 {
+			t.Errorf("(%v, %v) projected %g m off the reference", p[0], p[1], e)
+		}
+
+		x, y = latLngToWebMerc32(float32(p[0]), float32(p[1]))
+		worst32 = math.Max(worst32, dist(x, y, wantX, wantY))
+	}
+
+	// float32 quantizes projected coordinates of several thousand kilometers
+	// to about a meter
+	if worst32 < 0.1 {
+		t.Errorf("float32 projection is only %g m off, expected a visible loss", worst32)
+	}
+}
+
+func TestEnuPerpDist(t *testing.T) {
+	for _, lat := range []float64{0, 48, 65} {
+		// a diagonal segment of about 1.4 km
+		alat, alon := offset(lat, 10, -500, -500)
+		blat, blon := offset(lat, 10, 500, 500)
+
+		// stops beside the segment, near its middle and beyond its end
+		for _, off := range [][2]float64{{150, -150}, {-40, 40}, {900, 700}, {-700, -400}} {
+			plat, plon := offset(lat, 10, off[0], off[1])
+			want := haversinePerpDist(plat, plon, alat, alon, blat, blon)
+			if got := enuPerpDist(plat, plon, alat, alon, blat, blon); math.Abs(got-want) > 0.5 {
+				t.Errorf("at %v degrees, offset %v: ENU distance %.3f m, haversine %.3f m", lat, off, got, want)
+			}
+		}
+	}
+}
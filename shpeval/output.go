@@ -0,0 +1,1165 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"encoding/json"
+	"fmt"
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// version of the JSON structure of Summary. The major version is increased
+// when fields are renamed, removed or change their meaning, the minor version
+// when fields are added.
+var SCHEMA_VERSION string = "1.0.0"
+
+type Summary struct {
+	SchemaVersion string `json:"schema_version"`
+	// true if the deadline was exceeded before all feeds were evaluated
+	Partial     bool        `json:"partial,omitempty"`
+	Feeds       int         `json:"feeds"`
+	FailedFeeds int         `json:"failed_feeds"`
+	Failed      []FeedError `json:"failed,omitempty"`
+	// feeds whose parsing or evaluation panicked, not included in FailedFeeds
+	PanickedFeeds      int         `json:"panicked_feeds"`
+	Panicked           []FeedError `json:"panicked,omitempty"`
+	FeedsWithShapes    int         `json:"feeds_with_shapes"`
+	FeedsWithShapesPct float64     `json:"feeds_with_shapes_pct"`
+	Shapes             int         `json:"shapes"`
+	TripsPerShape      float64     `json:"trips_per_shape"`
+	Trips              int         `json:"trips"`
+	Ok                 int         `json:"ok"`
+	OkPct              float64     `json:"ok_pct"`
+	// worst stop between WarnDist and the max distance, none if WarnDist is 0
+	WarnDist          float64 `json:"warn_dist,omitempty"`
+	Borderline        int     `json:"borderline"`
+	BorderlinePct     float64 `json:"borderline_pct"`
+	Suspicious        int     `json:"suspicious"`
+	SuspiciousPct     float64 `json:"suspicious_pct"`
+	Degenerate        int     `json:"degenerate"`
+	DegeneratePct     float64 `json:"degenerate_pct"`
+	Malformed         int     `json:"malformed"`
+	MalformedPct      float64 `json:"malformed_pct"`
+	EmptyShape        int     `json:"empty_shape"`
+	EmptyShapePct     float64 `json:"empty_shape_pct"`
+	DegFewPoints      int     `json:"degenerate_few_points"`
+	DegCollinear      int     `json:"degenerate_collinear"`
+	DegShort          int     `json:"degenerate_short"`
+	DegSparse         int     `json:"degenerate_sparse"`
+	BadSeqShapes      int     `json:"bad_sequence_shapes"`
+	BadSeqSorted      bool    `json:"bad_sequence_sorted"`
+	DupPointShapes    int     `json:"dup_point_shapes"`
+	DupPoints         int     `json:"dup_points"`
+	DupPointsRemoved  bool    `json:"dup_points_removed"`
+	IgnoredNonStops   int     `json:"ignored_nonstop_stop_times"`
+	ParentCoordStops  int     `json:"parent_coord_stops"`
+	SkippedNullStops  *int    `json:"skipped_null_stop_times,omitempty"`
+	SkippedNullTrips  *int    `json:"skipped_null_trips,omitempty"`
+	SkippedFewStops   *int    `json:"skipped_few_stop_trips,omitempty"`
+	AntimeridianTrips int     `json:"antimeridian_trips"`
+	OutOfOrder        int     `json:"out_of_order"`
+	Impossible        int     `json:"impossible_shapes"`
+	Truncated         int     `json:"truncated"`
+	// mean gap in meters over all truncated shape ends
+	TruncatedMeanGap float64               `json:"truncated_mean_gap"`
+	Reversed         int                   `json:"reversed"`
+	ReversedPct      float64               `json:"reversed_pct"`
+	NoShape          int                   `json:"no_shape"`
+	NoShapePct       float64               `json:"no_shape_pct"`
+	RequireShapes    bool                  `json:"require_shapes"`
+	OkBasis          string                `json:"ok_basis"`
+	ScorePct         float64               `json:"score_pct"`
+	Sample           float64               `json:"sample,omitempty"`
+	SampledTrips     int                   `json:"sampled_trips,omitempty"`
+	ByRouteType      map[string]Counts     `json:"by_route_type,omitempty"`
+	ByAgency         map[string]Counts     `json:"by_agency,omitempty"`
+	Weighted         *WeightedSummary      `json:"weighted_by_service,omitempty"`
+	AutoDist         *AutoDistSummary      `json:"auto_dist,omitempty"`
+	FracDist         *FracDistSummary      `json:"max_dist_frac,omitempty"`
+	Detour           *DetourSummary        `json:"detour,omitempty"`
+	Density          *DensitySummary       `json:"density,omitempty"`
+	ShapeLengthKm    *float64              `json:"shape_length_km,omitempty"`
+	SelfIntersecting *int                  `json:"self_intersecting_shapes,omitempty"`
+	BadBearing       *int                  `json:"bad_bearing_trips,omitempty"`
+	ShortTrips       *int                  `json:"short_trips,omitempty"`
+	Tails            *TailSummary          `json:"spurious_tails,omitempty"`
+	OutsideBBox      *OutsideBBoxSummary   `json:"outside_stop_bbox,omitempty"`
+	Placeholder      *int                  `json:"placeholder_trips,omitempty"`
+	StopWeights      *StopWeightSummary    `json:"stop_weights,omitempty"`
+	BBoxes           []FeedBBox            `json:"bboxes,omitempty"`
+	OrphanStops      *int                  `json:"orphan_stops,omitempty"`
+	DupShapes        *DupShapesSummary     `json:"dup_shapes,omitempty"`
+	DivergentStops   *DivergentSummary     `json:"divergent_stops,omitempty"`
+	DistTraveled     *DistTravSummary      `json:"dist_traveled,omitempty"`
+	Simplify         *SimplifySummary      `json:"simplify,omitempty"`
+	StopDists        *Distribution         `json:"stop_distances,omitempty"`
+	PointsPerStop    *PointsPerStopSummary `json:"points_per_stop,omitempty"`
+	Coverage         *Distribution         `json:"coverage_pct,omitempty"`
+	Offsets          *OffsetSummary        `json:"offsets,omitempty"`
+	Histogram        []HistogramBucket     `json:"histogram,omitempty"`
+	TopTrips         []SuspiciousTrip      `json:"top_trips,omitempty"`
+	Timings          *TimingSummary        `json:"timings,omitempty"`
+	Comparison       *Comparison           `json:"comparison,omitempty"`
+}
+
+// time spent on the feeds, parse and evaluation time are summed over all
+// feeds and may exceed the wall-clock time when feeds are evaluated in parallel
+type TimingSummary struct {
+	ParseSec float64 `json:"parse_seconds"`
+	EvalSec  float64 `json:"eval_seconds"`
+	// set by the caller, 0 if unknown
+	WallSec float64 `json:"wall_seconds,omitempty"`
+	// max number of shapes with cached projections at once, in any feed
+	PeakCachedShapes int `json:"peak_cached_shapes"`
+}
+
+// result of a single trip, streamed with --jsonl. The worst distance is only
+// set for trips with stops that were measured against their shape, the
+// fraction of shape points outside the stops' bounding box only for trips
+// flagged by MaxOutsideBBox.
+type TripResult struct {
+	Feed        string    `json:"feed"`
+	TripId      string    `json:"trip_id"`
+	Class       TripClass `json:"class"`
+	WorstDist   *float64  `json:"worst_distance,omitempty"`
+	OutsideBBox *float64  `json:"outside_bbox_frac,omitempty"`
+}
+
+// a feed that could not be downloaded or parsed and was skipped
+type FeedError struct {
+	Feed  string `json:"feed"`
+	Error string `json:"error"`
+}
+
+type Distribution struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// trip percentages where each trip is weighted by its number of departures
+type WeightedSummary struct {
+	OkPct         float64 `json:"ok_pct"`
+	BorderlinePct float64 `json:"borderline_pct"`
+	SuspiciousPct float64 `json:"suspicious_pct"`
+	DegeneratePct float64 `json:"degenerate_pct"`
+	MalformedPct  float64 `json:"malformed_pct"`
+	EmptyShapePct float64 `json:"empty_shape_pct"`
+	ReversedPct   float64 `json:"reversed_pct"`
+	NoShapePct    float64 `json:"no_shape_pct"`
+}
+
+// max distances derived from the stop spacing
+type FracDistSummary struct {
+	Frac       float64      `json:"frac"`
+	Cap        float64      `json:"cap"`
+	Thresholds Distribution `json:"thresholds"`
+}
+
+// max distances derived per feed from the percentile of its stop distances
+type AutoDistSummary struct {
+	Percentile float64      `json:"percentile"`
+	Margin     float64      `json:"margin"`
+	Thresholds Distribution `json:"thresholds"`
+}
+
+type DetourSummary struct {
+	MaxDetour float64      `json:"max_detour"`
+	Flagged   int          `json:"flagged"`
+	Factors   Distribution `json:"factors"`
+}
+
+// shape points per stop time of the trips with a shape. Ratios of exactly 1
+// usually mean a placeholder shape connecting the stops directly
+type PointsPerStopSummary struct {
+	Ratios   Distribution `json:"ratios"`
+	AtOne    int          `json:"at_one"`
+	AtOnePct float64      `json:"at_one_pct"`
+}
+
+// trips whose shape runs longer than MaxTail meters before their first or
+// after their last stop, and the lengths of those tails
+type TailSummary struct {
+	MaxTail float64      `json:"max_tail"`
+	Trips   int          `json:"trips"`
+	Tails   Distribution `json:"tails"`
+}
+
+// trips with more than MaxFrac of their shape points outside the bounding box
+// of their stops expanded by the max distance, and those fractions
+type OutsideBBoxSummary struct {
+	MaxFrac float64      `json:"max_frac"`
+	Trips   int          `json:"trips"`
+	Fracs   Distribution `json:"fracs"`
+}
+
+// stop distances split into the offsets across and along the nearest shape
+// segment, in meters. Large cross-track offsets suggest a shape on the wrong
+// street, large along-track offsets beyond the shape's ends a truncated shape.
+type OffsetSummary struct {
+	Cross Distribution `json:"cross_track"`
+	Along Distribution `json:"along_track"`
+	// stops beyond the start or the end of their shape
+	BeyondEnds int `json:"beyond_ends"`
+}
+
+// bounding box and centroid of a set of points, in degrees
+type BBox struct {
+	MinLat      float64 `json:"min_lat"`
+	MinLon      float64 `json:"min_lon"`
+	MaxLat      float64 `json:"max_lat"`
+	MaxLon      float64 `json:"max_lon"`
+	CentroidLat float64 `json:"centroid_lat"`
+	CentroidLon float64 `json:"centroid_lon"`
+	Points      int     `json:"points"`
+}
+
+// bounding boxes of the stops and, if it has any, the shape points of a feed
+type FeedBBox struct {
+	Feed   string `json:"feed"`
+	Stops  BBox   `json:"stops"`
+	Shapes *BBox  `json:"shapes,omitempty"`
+}
+
+// stops beyond the max distance of suspicious trips, weighted by
+// Options.StopWeights
+type StopWeightSummary struct {
+	SuspiciousTrips int     `json:"suspicious_trips"`
+	Stops           int     `json:"stops"`
+	Impact          float64 `json:"impact"`
+}
+
+// shape point densities, in points per km
+type DensitySummary struct {
+	MaxDensity float64       `json:"max_density,omitempty"`
+	OverDense  int           `json:"over_dense"`
+	MinDensity float64       `json:"min_density,omitempty"`
+	UnderDense int           `json:"under_dense"`
+	Densities  *Distribution `json:"points_per_km,omitempty"`
+}
+
+// points of the used shapes that Douglas-Peucker simplification could drop
+type SimplifySummary struct {
+	Epsilon    float64 `json:"epsilon"`
+	Points     int     `json:"points"`
+	Dropped    int     `json:"dropped"`
+	DroppedPct float64 `json:"dropped_pct"`
+	Rejected   int     `json:"rejected_shapes"`
+}
+
+// consistency of shape_dist_traveled, only shapes with a value on all points
+// and the trips using them are checked
+type DistTravSummary struct {
+	Shapes           int `json:"shapes"`
+	DecreasingShapes int `json:"decreasing_shapes"`
+	Trips            int `json:"trips"`
+	DecreasingTrips  int `json:"decreasing_trips"`
+	OutsideStopTimes int `json:"outside_stop_times"`
+}
+
+// shapes shared by trips whose stops differ from those of the shape's most
+// common stop pattern
+type DivergentSummary struct {
+	MinSimilarity float64 `json:"min_similarity"`
+	Shapes        int     `json:"shapes"`
+	Trips         int     `json:"trips"`
+}
+
+// shapes sharing their geometry with another shape of the same feed
+type DupShapesSummary struct {
+	Epsilon float64 `json:"epsilon"`
+	Groups  int     `json:"groups"`
+	Shapes  int     `json:"redundant_shapes"`
+	Points  int     `json:"redundant_points"`
+}
+
+type GeoJsonGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoJsonFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJsonGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJsonFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJsonFeature `json:"features"`
+}
+
+// number of distances in [From, To), To is 0 for the last, open-ended bucket
+type HistogramBucket struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to,omitempty"`
+	Count int     `json:"count"`
+}
+
+func newHistogram(vals []float64, bounds []float64) []HistogramBucket {
+	ret := make([]HistogramBucket, len(bounds)+1)
+	for i := range ret {
+		if i > 0 {
+			ret[i].From = bounds[i-1]
+		}
+		if i < len(bounds) {
+			ret[i].To = bounds[i]
+		}
+	}
+
+	for _, v := range vals {
+		ret[sort.SearchFloat64s(bounds, math.Nextafter(v, math.Inf(1)))].Count += 1
+	}
+
+	return ret
+}
+
+func fmtBBox(b BBox) string {
+	return fmt.Sprintf("%.6f,%.6f - %.6f,%.6f (%.6f,%.6f)", b.MinLat, b.MinLon, b.MaxLat, b.MaxLon, b.CentroidLat, b.CentroidLon)
+}
+
+// prints the histogram as a text bar chart, scaled to the largest bucket
+func printHistogram(w io.Writer, buckets []HistogramBucket) {
+	maxCount := 0
+	for _, b := range buckets {
+		if b.Count > maxCount {
+			maxCount = b.Count
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, b := range buckets {
+		label := fmt.Sprintf("%g - %g m", b.From, b.To)
+		if b.To == 0 {
+			label = fmt.Sprintf("> %g m", b.From)
+		}
+		bar := ""
+		if maxCount > 0 {
+			bar = strings.Repeat("#", int(math.Round(float64(b.Count)/float64(maxCount)*50)))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", label, b.Count, bar)
+	}
+	tw.Flush()
+}
+
+// nearest-rank percentile of an ascendingly sorted slice
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100.0*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func newDistribution(vals []float64) Distribution {
+	if len(vals) == 0 {
+		return Distribution{}
+	}
+
+	sort.Float64s(vals)
+
+	return Distribution{
+		Count: len(vals),
+		Min:   vals[0],
+		P50:   percentile(vals, 50),
+		P90:   percentile(vals, 90),
+		P95:   percentile(vals, 95),
+		P99:   percentile(vals, 99),
+		Max:   vals[len(vals)-1],
+	}
+}
+
+func fpct(a float64, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b * 100.0
+}
+
+func pct(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b) * 100.0
+}
+
+// builds the summary of the aggregated results, optional sections are only
+// included if enabled in opts or by the breakdown flags
+func NewSummary(res FeedResult, opts Options, byRouteType bool, byAgency bool) Summary {
+	sum := Summary{
+		SchemaVersion:      SCHEMA_VERSION,
+		Feeds:              res.Feeds,
+		FeedsWithShapes:    res.FeedsWithShapes,
+		FeedsWithShapesPct: pct(res.FeedsWithShapes, res.Feeds),
+		Shapes:             res.Shapes,
+		Trips:              res.Trips,
+		Ok:                 res.Ok,
+		OkPct:              pct(res.Ok, res.Trips),
+		WarnDist:           opts.WarnDist,
+		Borderline:         res.Borderline,
+		BorderlinePct:      pct(res.Borderline, res.Trips),
+		Suspicious:         res.Suspicious,
+		SuspiciousPct:      pct(res.Suspicious, res.Trips),
+		Degenerate:         res.Degenerate,
+		DegeneratePct:      pct(res.Degenerate, res.Trips),
+		Malformed:          res.Malformed,
+		MalformedPct:       pct(res.Malformed, res.Trips),
+		EmptyShape:         res.EmptyShape,
+		EmptyShapePct:      pct(res.EmptyShape, res.Trips),
+		DegFewPoints:       res.DegReasons["few-points"],
+		DegCollinear:       res.DegReasons["collinear"],
+		DegShort:           res.DegReasons["short"],
+		DegSparse:          res.DegReasons["sparse"],
+		BadSeqShapes:       res.BadSeq,
+		BadSeqSorted:       opts.SortShapes,
+		DupPointShapes:     res.DupPointShapes,
+		DupPoints:          res.DupPoints,
+		DupPointsRemoved:   opts.DedupPoints,
+		IgnoredNonStops:    res.NonStops,
+		ParentCoordStops:   res.ParentCoordStops,
+		AntimeridianTrips:  res.Antimeridian,
+		OutOfOrder:         res.OutOfOrder,
+		Impossible:         res.Impossible,
+		Truncated:          res.Truncated,
+		Reversed:           res.Reversed,
+		ReversedPct:        pct(res.Reversed, res.Trips),
+		NoShape:            res.NoShape,
+		NoShapePct:         pct(res.NoShape, res.Trips),
+		RequireShapes:      opts.RequireShapes,
+		OkBasis:            opts.okBasis(),
+	}
+
+	if res.Shapes > 0 {
+		sum.TripsPerShape = float64(res.ShapedTrips) / float64(res.Shapes)
+	}
+
+	if res.TruncatedEnds > 0 {
+		sum.TruncatedMeanGap = res.TruncatedGaps / float64(res.TruncatedEnds)
+	}
+
+	// OK trips among all trips (trips without a shape count as errors), among
+	// those with a shape, or among those with a non-degenerate shape.
+	// Borderline trips are still within their max distance.
+	switch sum.OkBasis {
+	case "all":
+		sum.ScorePct = pct(res.Ok+res.Borderline, res.Trips)
+	case "nondegenerate":
+		sum.ScorePct = pct(res.Ok+res.Borderline, res.Trips-res.NoShape-res.Degenerate)
+	default:
+		sum.ScorePct = pct(res.Ok+res.Borderline, res.Trips-res.NoShape)
+	}
+
+	if byRouteType {
+		sum.ByRouteType = make(map[string]Counts)
+		for t, c := range res.ByRouteType {
+			sum.ByRouteType[routeTypeName(t)] = *c
+		}
+	}
+
+	if byAgency {
+		sum.ByAgency = make(map[string]Counts)
+		for a, c := range res.ByAgency {
+			sum.ByAgency[a] = *c
+		}
+	}
+
+	if opts.Sample > 0 && opts.Sample < 1 {
+		// extrapolate absolute trip counts, percentages stay those of the sample
+		f := 0.0
+		if res.Trips > 0 {
+			f = float64(res.AllTrips) / float64(res.Trips)
+		}
+
+		c := res.Counts.scaled(f)
+		sum.Sample = opts.Sample
+		sum.SampledTrips = res.Trips
+		sum.Trips = res.AllTrips
+		sum.Ok = c.Ok
+		sum.Borderline = c.Borderline
+		sum.Suspicious = c.Suspicious
+		sum.Degenerate = c.Degenerate
+		sum.Malformed = c.Malformed
+		sum.EmptyShape = c.EmptyShape
+		sum.Reversed = c.Reversed
+		sum.NoShape = c.NoShape
+		sum.DegFewPoints = scaleCount(sum.DegFewPoints, f)
+		sum.DegCollinear = scaleCount(sum.DegCollinear, f)
+		sum.DegShort = scaleCount(sum.DegShort, f)
+		sum.DegSparse = scaleCount(sum.DegSparse, f)
+
+		for k, c := range sum.ByRouteType {
+			sum.ByRouteType[k] = c.scaled(f)
+		}
+		for k, c := range sum.ByAgency {
+			sum.ByAgency[k] = c.scaled(f)
+		}
+	}
+
+	if opts.WeightByService {
+		w := res.Weighted
+		sum.Weighted = &WeightedSummary{
+			OkPct:         fpct(w[string(CLASS_OK)], w["all"]),
+			BorderlinePct: fpct(w[string(CLASS_BORDERLINE)], w["all"]),
+			SuspiciousPct: fpct(w[string(CLASS_SUSPICIOUS)], w["all"]),
+			DegeneratePct: fpct(w[string(CLASS_DEGENERATE)], w["all"]),
+			MalformedPct:  fpct(w[string(CLASS_MALFORMED)], w["all"]),
+			EmptyShapePct: fpct(w[string(CLASS_EMPTY_SHAPE)], w["all"]),
+			ReversedPct:   fpct(w[string(CLASS_REVERSED)], w["all"]),
+			NoShapePct:    fpct(w[string(CLASS_NO_SHAPE)], w["all"]),
+		}
+	}
+
+	if opts.Stats {
+		d := newDistribution(res.StopDists)
+		sum.StopDists = &d
+		sum.PointsPerStop = &PointsPerStopSummary{Ratios: newDistribution(res.PointRatios), AtOne: res.PointRatioOne, AtOnePct: pct(res.PointRatioOne, len(res.PointRatios))}
+	}
+
+	if opts.MaxTail > 0 {
+		sum.Tails = &TailSummary{MaxTail: opts.MaxTail, Trips: res.TailTrips, Tails: newDistribution(res.Tails)}
+	}
+
+	if opts.MaxOutsideBBox > 0 {
+		sum.OutsideBBox = &OutsideBBoxSummary{MaxFrac: opts.MaxOutsideBBox, Trips: res.OutsideBBoxTrips, Fracs: newDistribution(res.OutsideBBoxFracs)}
+	}
+
+	if opts.Offsets {
+		sum.Offsets = &OffsetSummary{Cross: newDistribution(res.CrossOffsets), Along: newDistribution(res.AlongOffsets), BeyondEnds: res.BeyondEnds}
+	}
+
+	if opts.Coverage {
+		d := newDistribution(res.Coverages)
+		sum.Coverage = &d
+	}
+
+	if opts.Histogram != nil {
+		sum.Histogram = newHistogram(res.StopDists, opts.Histogram)
+	}
+
+	if opts.AutoDist {
+		sum.AutoDist = &AutoDistSummary{Percentile: opts.AutoDistPct, Margin: opts.AutoDistMargin, Thresholds: newDistribution(res.AutoDists)}
+	}
+
+	if opts.MaxDistFrac > 0 {
+		sum.FracDist = &FracDistSummary{Frac: opts.MaxDistFrac, Cap: opts.MaxDistFracCap, Thresholds: newDistribution(res.FracMaxDists)}
+	}
+
+	if opts.MaxDetour > 0 {
+		sum.Detour = &DetourSummary{MaxDetour: opts.MaxDetour, Flagged: res.NumDetour, Factors: newDistribution(res.Detours)}
+	}
+
+	if opts.SelfIntersect {
+		n := res.NumSelfInters
+		sum.SelfIntersecting = &n
+	}
+
+	if opts.MinLengthRatio > 0 {
+		n := res.ShortTrips
+		sum.ShortTrips = &n
+	}
+
+	if opts.BBox {
+		sum.BBoxes = append([]FeedBBox{}, res.BBoxes...)
+		sort.Slice(sum.BBoxes, func(i, j int) bool { return sum.BBoxes[i].Feed < sum.BBoxes[j].Feed })
+	}
+
+	if opts.StopWeights != nil {
+		sum.StopWeights = &StopWeightSummary{SuspiciousTrips: res.Suspicious, Stops: res.ImpactStops, Impact: res.Impact}
+	}
+
+	if opts.PlaceholderRatio > 0 {
+		n := res.Placeholder
+		sum.Placeholder = &n
+	}
+
+	if opts.MaxBearingDiff > 0 {
+		n := res.BadBearing
+		sum.BadBearing = &n
+	}
+
+	if opts.Timings {
+		sum.Timings = &TimingSummary{ParseSec: res.ParseTime.Seconds(), EvalSec: res.EvalTime.Seconds(), PeakCachedShapes: res.PeakCachedShapes}
+	}
+
+	if opts.Top > 0 {
+		sum.TopTrips = topTrips(append([]SuspiciousTrip{}, res.Top...), opts.Top)
+	}
+
+	if opts.SkipNullCoords {
+		stops, trips := res.NullStops, res.NullTrips
+		sum.SkippedNullStops = &stops
+		sum.SkippedNullTrips = &trips
+	}
+
+	if opts.MinStops > 0 {
+		n := res.FewStopTrips
+		sum.SkippedFewStops = &n
+	}
+
+	if opts.OrphanStops {
+		n := res.NumOrphanStops
+		sum.OrphanStops = &n
+	}
+
+	if opts.CheckDistTraveled {
+		sum.DistTraveled = &DistTravSummary{
+			Shapes:           res.DistTravShapes,
+			DecreasingShapes: res.DistTravDecShapes,
+			Trips:            res.DistTravTrips,
+			DecreasingTrips:  res.DistTravDecTrips,
+			OutsideStopTimes: res.DistTravOutside,
+		}
+	}
+
+	if opts.MinStopSimilarity > 0 {
+		sum.DivergentStops = &DivergentSummary{MinSimilarity: opts.MinStopSimilarity, Shapes: res.DivergentShapes, Trips: res.DivergentTrips}
+	}
+
+	if opts.FindDupShapes {
+		sum.DupShapes = &DupShapesSummary{
+			Epsilon: opts.Epsilon,
+			Groups:  res.DupShapeGroups,
+			Shapes:  res.DupShapes,
+			Points:  res.DupShapePoints,
+		}
+	}
+
+	if opts.Simplify > 0 {
+		sum.Simplify = &SimplifySummary{Epsilon: opts.Simplify, Points: res.SimplifyPoints, Dropped: res.SimplifyDropped, DroppedPct: pct(res.SimplifyDropped, res.SimplifyPoints), Rejected: res.SimplifyRejects}
+	}
+
+	if opts.ShapeLength {
+		l := res.ShapeLength / 1000.0
+		sum.ShapeLengthKm = &l
+	}
+
+	if opts.Stats || opts.MaxDensity > 0 || opts.MinDensity > 0 {
+		sum.Density = &DensitySummary{MaxDensity: opts.MaxDensity, OverDense: res.NumOverDense, MinDensity: opts.MinDensity, UnderDense: res.NumUnderDense}
+		if opts.Stats {
+			d := newDistribution(res.Densities)
+			sum.Density.Densities = &d
+		}
+	}
+
+	return sum
+}
+
+// shape and too distant stops of a suspicious trip, stop distances in unit
+func suspiciousFeatures(feedPath string, trip *gtfs.Trip, dists []float64, maxDists []float64, unit string) []GeoJsonFeature {
+	coords := make([][]float64, 0, len(trip.Shape.Points))
+	for _, p := range trip.Shape.Points {
+		coords = append(coords, []float64{float64(p.Lon), float64(p.Lat)})
+	}
+
+	ret := []GeoJsonFeature{{
+		Type:       "Feature",
+		Geometry:   GeoJsonGeometry{Type: "LineString", Coordinates: coords},
+		Properties: map[string]interface{}{"feed": feedPath, "trip_id": trip.Id, "shape_id": trip.Shape.Id},
+	}}
+
+	for i, st := range trip.StopTimes {
+		if dists[i] <= maxDists[i] {
+			continue
+		}
+		ret = append(ret, GeoJsonFeature{
+			Type:       "Feature",
+			Geometry:   GeoJsonGeometry{Type: "Point", Coordinates: []float64{float64(st.Stop.Lon), float64(st.Stop.Lat)}},
+			Properties: map[string]interface{}{"feed": feedPath, "trip_id": trip.Id, "stop_id": st.Stop.Id, "stop_sequence": st.Sequence, "distance": toUnit(dists[i], unit), "unit": unitName(unit)},
+		})
+	}
+
+	return ret
+}
+
+var ROUTE_TYPE_NAMES = map[int16]string{0: "tram", 1: "subway", 2: "rail", 3: "bus", 4: "ferry", 5: "cable tram", 6: "aerial lift", 7: "funicular", 11: "trolleybus", 12: "monorail"}
+
+func routeTypeName(t int16) string {
+	if n, ok := ROUTE_TYPE_NAMES[t]; ok {
+		return fmt.Sprintf("%d (%s)", t, n)
+	}
+	return strconv.Itoa(int(t))
+}
+
+func agencyLabel(a *gtfs.Agency) string {
+	if a == nil {
+		return ""
+	}
+	if a.Id == "" {
+		return a.Name
+	}
+	return fmt.Sprintf("%s (%s)", a.Id, a.Name)
+}
+
+// prints a table of trip counts per group, followed by a total row
+func printCountsTable(w io.Writer, header string, keys []string, counts map[string]Counts) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tTrips\tOK\tBorderline\tSuspicious\tDegenerated\tMalformed\tEmpty shape\tReversed\tNo shape\t\n", header)
+
+	total := Counts{}
+	for _, k := range keys {
+		c := counts[k]
+		total.merge(c)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", k, c.Trips, c.Ok, c.Borderline, c.Suspicious, c.Degenerate, c.Malformed, c.EmptyShape, c.Reversed, c.NoShape)
+	}
+
+	fmt.Fprintf(tw, "Total\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", total.Trips, total.Ok, total.Borderline, total.Suspicious, total.Degenerate, total.Malformed, total.EmptyShape, total.Reversed, total.NoShape)
+	tw.Flush()
+}
+
+type SuspiciousTrip struct {
+	Feed    string  `json:"feed"`
+	TripId  string  `json:"trip_id"`
+	RouteId string  `json:"route_id"`
+	StopId  string  `json:"stop_id"`
+	Dist    float64 `json:"distance"`
+}
+
+// a stop and its max distance to the shape of any trip serving it
+type WorstStop struct {
+	Feed     string  `json:"feed"`
+	StopId   string  `json:"stop_id"`
+	StopName string  `json:"stop_name"`
+	Lat      float64 `json:"stop_lat"`
+	Lon      float64 `json:"stop_lon"`
+	Dist     float64 `json:"distance"`
+	// the trip the distance was measured for
+	TripId string `json:"trip_id"`
+}
+
+// the n stops with the largest distances, ties broken by stop id
+func worstStops(stops map[*gtfs.Stop]WorstStop, n int) []WorstStop {
+	ret := make([]WorstStop, 0, len(stops))
+	for _, w := range stops {
+		ret = append(ret, w)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Dist != ret[j].Dist {
+			return ret[i].Dist > ret[j].Dist
+		}
+		return ret[i].StopId < ret[j].StopId
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// CSV rows of the stops, distances in unit
+func WorstStopRows(stops []WorstStop, unit string) [][]string {
+	ret := make([][]string, 0, len(stops))
+	for _, w := range stops {
+		ret = append(ret, []string{w.Feed, w.StopId, w.StopName, strconv.FormatFloat(w.Lat, 'f', 6, 64), strconv.FormatFloat(w.Lon, 'f', 6, 64), strconv.FormatFloat(toUnit(w.Dist, unit), 'f', unitPrec(unit), 64), w.TripId})
+	}
+	return ret
+}
+
+// per-feed report written to --report-dir
+type FeedReport struct {
+	Feed       string           `json:"feed"`
+	Summary    Summary          `json:"summary"`
+	WorstTrips []SuspiciousTrip `json:"worst_trips"`
+}
+
+// file name for outputs derived from the feed at path, e.g. data_de_vbb.zip
+func feedName(path string) string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "http://"), "https://")
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, filepath.Clean(path))
+	return strings.Trim(name, "_.")
+}
+
+// file name of the report of the feed at path, e.g. data_de_vbb.zip.json
+func reportName(path string) string {
+	return feedName(path) + ".json"
+}
+
+func WriteFeedReport(dir string, rep FeedReport) error {
+	f, err := os.Create(filepath.Join(dir, reportName(rep.Feed)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+// serializes writes of concurrently evaluated feeds
+type SyncWriter struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (sw *SyncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.W.Write(p)
+}
+
+func sortedKeys(m map[string]Counts) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// route type keys ordered by their numeric route type
+func sortedRouteTypeKeys(m map[string]Counts) []string {
+	ret := sortedKeys(m)
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.SplitN(ret[i], " ", 2)[0])
+		b, _ := strconv.Atoi(strings.SplitN(ret[j], " ", 2)[0])
+		return a < b
+	})
+	return ret
+}
+
+// ANSI escape sequences used by PrintColorTextSummary
+var ANSI_RED string = "\x1b[31m"
+var ANSI_YELLOW string = "\x1b[33m"
+var ANSI_GREEN string = "\x1b[32m"
+var ANSI_RESET string = "\x1b[0m"
+
+// thresholds in percent for colorizing the text summary: scores below Red are
+// red, below Yellow yellow and green otherwise
+type SummaryColors struct {
+	Red    float64
+	Yellow float64
+}
+
+// the percentage colored against the thresholds, uncolored if c is nil
+func (c *SummaryColors) pct(p float64) string {
+	s := fmt.Sprintf("%.2f %%", p)
+	if c == nil {
+		return s
+	}
+	color := ANSI_GREEN
+	if p < c.Red {
+		color = ANSI_RED
+	} else if p < c.Yellow {
+		color = ANSI_YELLOW
+	}
+	return color + s + ANSI_RESET
+}
+
+// the count, red if bad and green otherwise, uncolored if c is nil
+func (c *SummaryColors) count(n int, bad bool) string {
+	s := strconv.Itoa(n)
+	if c == nil {
+		return s
+	}
+	if bad {
+		return ANSI_RED + s + ANSI_RESET
+	}
+	return ANSI_GREEN + s + ANSI_RESET
+}
+
+func PrintTextSummary(w io.Writer, sum Summary) {
+	PrintColorTextSummary(w, sum, nil)
+}
+
+// Prints the text summary like PrintTextSummary, with the OK percentage and
+// the score colored against the thresholds in colors and the number of
+// suspicious trips red if there are any. Uncolored if colors is nil.
+func PrintColorTextSummary(w io.Writer, sum Summary, colors *SummaryColors) {
+	fmt.Fprintf(w, "\nAnalyzed %d feeds with %d trips\n", sum.Feeds, sum.Trips)
+
+	if sum.FailedFeeds > 0 {
+		fmt.Fprintf(w, "\n%d of %d feeds failed to parse and were skipped:\n", sum.FailedFeeds, sum.Feeds+sum.FailedFeeds+sum.PanickedFeeds)
+		for _, f := range sum.Failed {
+			fmt.Fprintf(w, "  %s: %s\n", f.Feed, strings.ReplaceAll(f.Error, "\n", " "))
+		}
+	}
+
+	if sum.PanickedFeeds > 0 {
+		fmt.Fprintf(w, "\n%d of %d feeds crashed the parser or the evaluation and were skipped:\n", sum.PanickedFeeds, sum.Feeds+sum.FailedFeeds+sum.PanickedFeeds)
+		for _, f := range sum.Panicked {
+			fmt.Fprintf(w, "  %s: %s\n", f.Feed, strings.ReplaceAll(f.Error, "\n", " "))
+		}
+	}
+
+	if sum.Partial {
+		fmt.Fprintf(w, "\nDeadline exceeded, only feeds evaluated completely before it are included\n")
+	}
+
+	if sum.Sample > 0 {
+		fmt.Fprintf(w, "\nSampled run: evaluated %d trips (a fraction of %.2f), trip counts below are extrapolated\n", sum.SampledTrips, sum.Sample)
+	}
+
+	// also if they were the only ones
+	if sum.SkippedFewStops != nil {
+		fmt.Fprintf(w, "\nSkipped %d trips with less than --min-stops stop times\n", *sum.SkippedFewStops)
+	}
+
+	if sum.Trips == 0 {
+		fmt.Fprintf(w, "\nNo trips analyzed\n")
+		return
+	}
+
+	fmt.Fprintf(w, "\n%d feeds had shapes (%.2f %%)\n", sum.FeedsWithShapes, sum.FeedsWithShapesPct)
+
+	if sum.Shapes > 0 {
+		fmt.Fprintf(w, "\n%d distinct shapes, used by %.2f trips per shape on average\n", sum.Shapes, sum.TripsPerShape)
+	}
+	fmt.Fprintf(w, "\n%d trips with OK shape (%s), %s trips with suspicious shapes (%.2f %%), %d trips with degenerated shapes (%.2f %%), %d trips with malformed shapes (%.2f %%), %d trips with empty shapes (%.2f %%), %d trips with reversed shapes (%.2f %%), %d trips with no shapes (%.2f %%)\n", sum.Ok, colors.pct(sum.OkPct), colors.count(sum.Suspicious, sum.Suspicious > 0), sum.SuspiciousPct, sum.Degenerate, sum.DegeneratePct, sum.Malformed, sum.MalformedPct, sum.EmptyShape, sum.EmptyShapePct, sum.Reversed, sum.ReversedPct, sum.NoShape, sum.NoShapePct)
+
+	if sum.WarnDist > 0 {
+		fmt.Fprintf(w, "\n%d trips with borderline shapes (%.2f %%), their worst stop is farther than %.2f m but within the max distance\n", sum.Borderline, sum.BorderlinePct, sum.WarnDist)
+	}
+
+	ok := "OK"
+	if sum.WarnDist > 0 {
+		ok = "OK or borderline"
+	}
+
+	// with the default basis and without trips lacking a shape or borderline
+	// trips, the score is the OK percentage above
+	showScore := sum.OkBasis != "shaped" || sum.NoShape > 0 || sum.WarnDist > 0
+
+	switch {
+	case !showScore:
+	case sum.OkBasis == "all":
+		fmt.Fprintf(w, "\nScore: %s of all trips %s, %d trips without shape counted as errors (basis: all)\n", colors.pct(sum.ScorePct), ok, sum.NoShape)
+	case sum.OkBasis == "nondegenerate":
+		fmt.Fprintf(w, "\nScore: %s of trips with a non-degenerated shape %s, %d trips with degenerated shapes not counted (basis: nondegenerate)\n", colors.pct(sum.ScorePct), ok, sum.Degenerate)
+	default:
+		fmt.Fprintf(w, "\nScore: %s of trips with a shape %s (basis: shaped)\n", colors.pct(sum.ScorePct), ok)
+	}
+
+	if sum.ByRouteType != nil {
+		fmt.Fprintln(w)
+		printCountsTable(w, "Route type", sortedRouteTypeKeys(sum.ByRouteType), sum.ByRouteType)
+	}
+
+	if sum.ByAgency != nil {
+		fmt.Fprintln(w)
+		printCountsTable(w, "Agency", sortedKeys(sum.ByAgency), sum.ByAgency)
+	}
+
+	if sum.Weighted != nil {
+		ws := sum.Weighted
+		fmt.Fprintf(w, "\nWeighted by service frequency: %.2f %% OK, %.2f %% borderline, %.2f %% suspicious, %.2f %% degenerated, %.2f %% malformed, %.2f %% empty shapes, %.2f %% reversed, %.2f %% no shapes\n", ws.OkPct, ws.BorderlinePct, ws.SuspiciousPct, ws.DegeneratePct, ws.MalformedPct, ws.EmptyShapePct, ws.ReversedPct, ws.NoShapePct)
+	}
+
+	if sum.Degenerate > 0 {
+		fmt.Fprintf(w, "\nDegenerated shapes: %d with less than 2 distinct points, %d collinear, %d too short for their stops, %d too sparse\n", sum.DegFewPoints, sum.DegCollinear, sum.DegShort, sum.DegSparse)
+	}
+
+	if sum.IgnoredNonStops > 0 {
+		fmt.Fprintf(w, "\nIgnored %d non-stopping stop times\n", sum.IgnoredNonStops)
+	}
+
+	if sum.ParentCoordStops > 0 {
+		fmt.Fprintf(w, "\n%d stops without coordinates took those of their parent station\n", sum.ParentCoordStops)
+	}
+
+	if sum.SkippedNullStops != nil {
+		fmt.Fprintf(w, "\nSkipped %d stop times at stops without coordinates, %d trips had no other stop and were not evaluated\n", *sum.SkippedNullStops, *sum.SkippedNullTrips)
+	}
+
+	if sum.Impossible > 0 {
+		fmt.Fprintf(w, "\n%d trips with shapes shorter than the distance between their first and last stop\n", sum.Impossible)
+	}
+
+	if sum.OutOfOrder > 0 {
+		fmt.Fprintf(w, "\n%d trips with stops out of order along their shape\n", sum.OutOfOrder)
+	}
+
+	if sum.Truncated > 0 {
+		fmt.Fprintf(w, "\n%d trips with shapes ending short of their first or last stop (mean gap %.2f m)\n", sum.Truncated, sum.TruncatedMeanGap)
+	}
+
+	if sum.AntimeridianTrips > 0 {
+		fmt.Fprintf(w, "\n%d trips with shapes crossing the antimeridian (measured with unwrapped longitudes)\n", sum.AntimeridianTrips)
+	}
+
+	if sum.BadSeqShapes > 0 {
+		if !sum.BadSeqSorted {
+			fmt.Fprintf(w, "\n%d shapes with points not ordered by shape_pt_sequence\n", sum.BadSeqShapes)
+		} else {
+			fmt.Fprintf(w, "\n%d shapes with points not ordered by shape_pt_sequence (sorted before evaluation)\n", sum.BadSeqShapes)
+		}
+	}
+
+	if sum.DupPointShapes > 0 {
+		if !sum.DupPointsRemoved {
+			fmt.Fprintf(w, "\n%d shapes with %d duplicate consecutive points\n", sum.DupPointShapes, sum.DupPoints)
+		} else {
+			fmt.Fprintf(w, "\n%d shapes with %d duplicate consecutive points (removed before evaluation)\n", sum.DupPointShapes, sum.DupPoints)
+		}
+	}
+
+	if sum.StopDists != nil {
+		d := sum.StopDists
+		fmt.Fprintf(w, "\nStop-to-shape distances of %d stops: p50 %.2f m, p90 %.2f m, p95 %.2f m, p99 %.2f m, max %.2f m\n", d.Count, d.P50, d.P90, d.P95, d.P99, d.Max)
+	}
+
+	if p := sum.PointsPerStop; p != nil {
+		fmt.Fprintf(w, "\nShape points per stop of %d trips: min %.2f, median %.2f, p90 %.2f, max %.2f, %d trips (%.2f %%) with exactly one point per stop\n", p.Ratios.Count, p.Ratios.Min, p.Ratios.P50, p.Ratios.P90, p.Ratios.Max, p.AtOne, p.AtOnePct)
+	}
+
+	if o := sum.Offsets; o != nil {
+		fmt.Fprintf(w, "\nCross-track offsets of %d stops: p50 %.2f m, p90 %.2f m, p95 %.2f m, p99 %.2f m, max %.2f m\n", o.Cross.Count, o.Cross.P50, o.Cross.P90, o.Cross.P95, o.Cross.P99, o.Cross.Max)
+		fmt.Fprintf(w, "Along-track offsets of %d stops: p50 %.2f m, p90 %.2f m, p95 %.2f m, p99 %.2f m, max %.2f m, %d stops beyond the ends of their shape\n", o.Along.Count, o.Along.P50, o.Along.P90, o.Along.P95, o.Along.P99, o.Along.Max, o.BeyondEnds)
+	}
+
+	if sum.Coverage != nil {
+		d := sum.Coverage
+		fmt.Fprintf(w, "\nShape length within the max distance of a stop, over %d trips: min %.2f %%, median %.2f %%, max %.2f %%\n", d.Count, d.Min, d.P50, d.Max)
+	}
+
+	if sum.Histogram != nil {
+		fmt.Fprintf(w, "\nStop-to-shape distance histogram:\n")
+		printHistogram(w, sum.Histogram)
+	}
+
+	if sum.AutoDist != nil {
+		a, d := sum.AutoDist, sum.AutoDist.Thresholds
+		if d.Count == 1 {
+			fmt.Fprintf(w, "\nAuto-calibrated max distance (p%.0f of stop distances + %.2f m): %.2f m, exceeded by %d trips\n", a.Percentile, a.Margin, d.Max, sum.Suspicious)
+		} else {
+			fmt.Fprintf(w, "\nAuto-calibrated max distances (p%.0f of stop distances + %.2f m) of %d feeds: min %.2f m, median %.2f m, max %.2f m, exceeded by %d trips\n", a.Percentile, a.Margin, d.Count, d.Min, d.P50, d.Max, sum.Suspicious)
+		}
+	}
+
+	if f := sum.FracDist; f != nil {
+		d := f.Thresholds
+		fmt.Fprintf(w, "\nMax distance of each stop: %.2f times its spacing to the neighboring stops, at least the max distance and at most %.2f m. Effective max distances of %d stops: min %.2f m, median %.2f m, p90 %.2f m, max %.2f m\n", f.Frac, f.Cap, d.Count, d.Min, d.P50, d.P90, d.Max)
+	}
+
+	if sum.Detour != nil {
+		d := sum.Detour.Factors
+		fmt.Fprintf(w, "\n%d trips with a detour factor above %.2f, detour factors of %d trips: min %.2f, median %.2f, p90 %.2f, p99 %.2f, max %.2f\n", sum.Detour.Flagged, sum.Detour.MaxDetour, d.Count, d.Min, d.P50, d.P90, d.P99, d.Max)
+	}
+
+	if sum.SelfIntersecting != nil {
+		fmt.Fprintf(w, "\n%d self-intersecting shapes\n", *sum.SelfIntersecting)
+	}
+
+	if t := sum.Tails; t != nil {
+		fmt.Fprintf(w, "\n%d trips with a spurious tail of more than %.2f m before their first or after their last stop", t.Trips, t.MaxTail)
+		if t.Tails.Count > 0 {
+			fmt.Fprintf(w, ", tail lengths: median %.2f m, p90 %.2f m, max %.2f m", t.Tails.P50, t.Tails.P90, t.Tails.Max)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if o := sum.OutsideBBox; o != nil {
+		fmt.Fprintf(w, "\n%d trips with more than %.2f %% of their shape points outside the bounding box of their stops expanded by the max distance", o.Trips, o.MaxFrac*100)
+		if o.Fracs.Count > 0 {
+			fmt.Fprintf(w, ", fractions outside: median %.2f %%, p90 %.2f %%, max %.2f %%", o.Fracs.P50*100, o.Fracs.P90*100, o.Fracs.Max*100)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if sum.ShortTrips != nil {
+		fmt.Fprintf(w, "\n%d trips with a shape shorter than --min-length-ratio times the median shape length of their route type\n", *sum.ShortTrips)
+	}
+
+	if len(sum.BBoxes) > 0 {
+		fmt.Fprintf(w, "\nBounding boxes (min lat,lon - max lat,lon, centroid):\n")
+		for _, b := range sum.BBoxes {
+			fmt.Fprintf(w, "  %s: %d stops %s", b.Feed, b.Stops.Points, fmtBBox(b.Stops))
+			if b.Shapes != nil {
+				fmt.Fprintf(w, ", %d shape points %s", b.Shapes.Points, fmtBBox(*b.Shapes))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if sw := sum.StopWeights; sw != nil {
+		fmt.Fprintf(w, "\n%d suspicious trips with %d stops beyond the max distance, weighted impact %.2f\n", sw.SuspiciousTrips, sw.Stops, sw.Impact)
+	}
+
+	if sum.Placeholder != nil {
+		fmt.Fprintf(w, "\n%d trips whose stops snap to less than --placeholder-ratio distinct positions per stop along their shape, likely placeholder shapes\n", *sum.Placeholder)
+	}
+
+	if sum.BadBearing != nil {
+		fmt.Fprintf(w, "\n%d trips with a stop pair whose direction differs from the shape by more than --max-bearing-diff\n", *sum.BadBearing)
+	}
+
+	if sum.OrphanStops != nil {
+		fmt.Fprintf(w, "\n%d stops farther than --max-dist from all shapes used by trips\n", *sum.OrphanStops)
+	}
+
+	if d := sum.DistTraveled; d != nil {
+		fmt.Fprintf(w, "\nshape_dist_traveled decreases in %d of %d shapes with values on all points and between the stops of %d of the %d trips using them, %d stop times lie outside of their shape's range\n", d.DecreasingShapes, d.Shapes, d.DecreasingTrips, d.Trips, d.OutsideStopTimes)
+	}
+
+	if d := sum.DivergentStops; d != nil {
+		fmt.Fprintf(w, "\n%d trips on %d shared shapes with stops of a Jaccard similarity below %.2f to those of their shape's most common stop pattern\n", d.Trips, d.Shapes, d.MinSimilarity)
+	}
+
+	if d := sum.DupShapes; d != nil {
+		fmt.Fprintf(w, "\n%d groups of shapes with identical geometry (within %.2f m), %d shapes with %d points could be dropped\n", d.Groups, d.Epsilon, d.Shapes, d.Points)
+	}
+
+	if sum.Simplify != nil {
+		sp := sum.Simplify
+		fmt.Fprintf(w, "\nSimplification with a tolerance of %.2f m could drop %d of %d shape points (%.2f %%), %d shapes could not be simplified without moving a stop beyond --max-dist\n", sp.Epsilon, sp.Dropped, sp.Points, sp.DroppedPct, sp.Rejected)
+	}
+
+	if sum.ShapeLengthKm != nil {
+		fmt.Fprintf(w, "\n%.2f km of distinct shape geometry\n", *sum.ShapeLengthKm)
+	}
+
+	if sum.Density != nil {
+		if sum.Density.MaxDensity > 0 {
+			fmt.Fprintf(w, "\n%d over-dense shapes with more than %.2f points per km\n", sum.Density.OverDense, sum.Density.MaxDensity)
+		}
+		if sum.Density.MinDensity > 0 {
+			fmt.Fprintf(w, "\n%d under-dense shapes with less than %.2f points per km\n", sum.Density.UnderDense, sum.Density.MinDensity)
+		}
+		if d := sum.Density.Densities; d != nil {
+			fmt.Fprintf(w, "\nPoint densities of %d shapes: min %.2f, median %.2f, p90 %.2f, p99 %.2f, max %.2f points per km\n", d.Count, d.Min, d.P50, d.P90, d.P99, d.Max)
+		}
+	}
+
+	if t := sum.Timings; t != nil {
+		fmt.Fprintf(w, "\nTimings: %.2f s parsing and %.2f s evaluating summed over all feeds", t.ParseSec, t.EvalSec)
+		if t.WallSec > 0 {
+			fmt.Fprintf(w, ", %.2f s wall-clock time", t.WallSec)
+		}
+		fmt.Fprintf(w, ", at most %d shapes cached at once\n", t.PeakCachedShapes)
+	}
+
+	if len(sum.TopTrips) > 0 {
+		fmt.Fprintf(w, "\n%d trips with the most distant stops:\n", len(sum.TopTrips))
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Distance\tFeed\tTrip\tStop\t\n")
+		for _, t := range sum.TopTrips {
+			fmt.Fprintf(tw, "%.2f m\t%s\t%s\t%s\t\n", t.Dist, t.Feed, t.TripId, t.StopId)
+		}
+		tw.Flush()
+	}
+
+	if sum.Comparison != nil {
+		printComparison(w, sum.Comparison)
+	}
+}
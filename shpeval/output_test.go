@@ -0,0 +1,105 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestFeedsWithShapesPct(t *testing.T) {
+	opts := DefaultOptions()
+	total := NewFeedResult()
+	for _, feed := range []string{"clean", "noshape"} {
+		total.Merge(evalFixture(t, filepath.Join("..", "testdata", feed), opts))
+	}
+
+	sum := NewSummary(total, opts, false, false)
+	if sum.Feeds != 2 || sum.FeedsWithShapes != 1 || sum.FeedsWithShapesPct != 50 {
+		t.Errorf("got %d of %d feeds with shapes (%.2f %%), want 1 of 2 (50.00 %%)", sum.FeedsWithShapes, sum.Feeds, sum.FeedsWithShapesPct)
+	}
+
+	var buf bytes.Buffer
+	PrintTextSummary(&buf, sum)
+	if !strings.Contains(buf.String(), "1 feeds had shapes (50.00 %)") {
+		t.Errorf("summary lacks the feeds with shapes:\n%s", buf.String())
+	}
+
+	if sum := NewSummary(NewFeedResult(), opts, false, false); sum.FeedsWithShapesPct != 0 {
+		t.Errorf("got %.2f %% feeds with shapes without feeds, want 0", sum.FeedsWithShapesPct)
+	}
+}
+
+// Lines of checks without findings are left out of the text summary of a
+// clean feed, they reappear once there is something to report.
+func TestTextSummaryCompact(t *testing.T) {
+	opts := DefaultOptions()
+
+	var buf bytes.Buffer
+	PrintTextSummary(&buf, NewSummary(evalFixture(t, filepath.Join("..", "testdata", "clean"), opts), opts, false, false))
+	for _, line := range []string{"Score:", "Degenerated shapes:", "out of order", "shorter than the distance", "ending short"} {
+		if strings.Contains(buf.String(), line) {
+			t.Errorf("summary of a clean feed contains %q:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	total := NewFeedResult()
+	for _, feed := range []string{"clean", "degenerate", "noshape"} {
+		total.Merge(evalFixture(t, filepath.Join("..", "testdata", feed), opts))
+	}
+	PrintTextSummary(&buf, NewSummary(total, opts, false, false))
+	for _, line := range []string{"Score: 50.00 %", "Degenerated shapes: 0 with less than 2 distinct points, 1 collinear"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("summary lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+// The JSON summary of all test feeds must match the golden file, so that
+// renamed or removed fields are noticed and SCHEMA_VERSION is bumped. Run
+// with -update to rewrite it after an intended change.
+func TestSummaryGolden(t *testing.T) {
+	opts := DefaultOptions()
+	total := NewFeedResult()
+	for _, feed := range []string{"clean", "degenerate", "distant", "empty", "noshape", "reversed"} {
+		total.Merge(evalFixture(t, filepath.Join("..", "testdata", feed), opts))
+	}
+
+	got, err := json.MarshalIndent(NewSummary(total, opts, true, true), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "summary.golden.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("JSON summary differs from %s, run with -update if intended:\n%s", golden, got)
+	}
+
+	var sum struct {
+		SchemaVersion string `json:"schema_version"`
+	}
+	if err := json.Unmarshal(got, &sum); err != nil || sum.SchemaVersion != SCHEMA_VERSION {
+		t.Errorf("got schema_version '%s', want '%s'", sum.SchemaVersion, SCHEMA_VERSION)
+	}
+}
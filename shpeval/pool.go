@@ -0,0 +1,87 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// how EvaluatePaths distributes the feeds
+type PoolOpts struct {
+	// number of workers, at least 1
+	Jobs int
+	// max number of feeds parsed and evaluated at the same time, as each
+	// holds its whole feed in memory. Workers serving feeds from the cache
+	// do not take a slot. At least 1
+	MaxInflight int
+	// results of unmodified feeds are taken from and stored in it, if not nil.
+	// It must have been loaded with the same options
+	Cache *ResultCache
+	// a line per started feed, like "[1/3] parsing <path>", if not nil
+	Progress io.Writer
+}
+
+// Evaluates the feeds at gtfsPaths in parallel and sends their results to the
+// returned channel in the order they finish. The channel is closed after the
+// last result, feeds not started before ctx is done are reported as canceled.
+func EvaluatePaths(ctx context.Context, gtfsPaths []string, opts Options, pool PoolOpts) <-chan FeedResult {
+	if pool.Jobs < 1 {
+		pool.Jobs = 1
+	}
+	if pool.MaxInflight < 1 {
+		pool.MaxInflight = 1
+	}
+	if pool.Progress == nil {
+		pool.Progress = io.Discard
+	}
+
+	paths := make(chan string)
+	results := make(chan FeedResult)
+	var wg sync.WaitGroup
+
+	// a slot is taken while a feed is parsed and evaluated
+	inflight := make(chan struct{}, pool.MaxInflight)
+
+	var started int32
+
+	for i := 0; i < pool.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gtfsPath := range paths {
+				if pool.Cache != nil {
+					if res, ok := pool.Cache.Get(gtfsPath); ok {
+						fmt.Fprintf(pool.Progress, "[%d/%d] cached %s\n", atomic.AddInt32(&started, 1), len(gtfsPaths), gtfsPath)
+						results <- res
+						continue
+					}
+				}
+				inflight <- struct{}{}
+				fmt.Fprintf(pool.Progress, "[%d/%d] parsing %s\n", atomic.AddInt32(&started, 1), len(gtfsPaths), gtfsPath)
+				res := EvaluatePath(ctx, gtfsPath, opts)
+				<-inflight
+				if pool.Cache != nil {
+					pool.Cache.Put(gtfsPath, res)
+				}
+				results <- res
+			}
+		}()
+	}
+
+	go func() {
+		for _, gtfsPath := range gtfsPaths {
+			paths <- gtfsPath
+		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
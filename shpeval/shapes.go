@@ -0,0 +1,934 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	"github.com/patrickbr/gtfsparser"
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func shapeLength(shp *gtfs.Shape, distMode string) float64 {
+	l := 0.0
+	for i := 1; i < len(shp.Points); i++ {
+		l += geoDist(shp.Points[i-1].Lat, shp.Points[i-1].Lon, shp.Points[i].Lat, shp.Points[i].Lon, distMode)
+	}
+	return l
+}
+
+// number of shape points per km of shape length, false for shapes without length
+func pointDensity(shp *gtfs.Shape, distMode string) (float64, bool) {
+	l := shapeLength(shp, distMode)
+	if l == 0 {
+		return 0, false
+	}
+	return float64(len(shp.Points)) / (l / 1000.0), true
+}
+
+// diagonal of the bounding box of the trip's stops, in meters
+func stopSpread(trip *gtfs.Trip, distMode string) float64 {
+	if len(trip.StopTimes) == 0 {
+		return 0
+	}
+
+	minLat, minLon := trip.StopTimes[0].Stop.Lat, trip.StopTimes[0].Stop.Lon
+	maxLat, maxLon := minLat, minLon
+
+	for _, st := range trip.StopTimes {
+		minLat = float32(math.Min(float64(minLat), float64(st.Stop.Lat)))
+		minLon = float32(math.Min(float64(minLon), float64(st.Stop.Lon)))
+		maxLat = float32(math.Max(float64(maxLat), float64(st.Stop.Lat)))
+		maxLon = float32(math.Max(float64(maxLon), float64(st.Stop.Lon)))
+	}
+
+	return geoDist(minLat, minLon, maxLat, maxLon, distMode)
+}
+
+// Returns why the shape of a trip is degenerate, or "" if it is not:
+//
+//	few-points: the shape has less than 2 points farther than eps meters
+//	            apart
+//	collinear:  the shape has at least 3 distinct points and all of them lie
+//	            within collinearTol meters of one of the trip's stops, i.e.
+//	            the shape is a placeholder of straight lines from stop to
+//	            stop. Shapes with 2 distinct points and straight shapes
+//	            between their stops are measured as usual
+//	short:      the shape is shorter than minLenRatio times the stop spread
+//	sparse:     the shape has less than minDensity points per km, i.e. it
+//	            is too coarse to follow the actual route (0 disables this)
+func degenerateReason(trip *gtfs.Trip, distMode string, eps float64, collinearTol float64, minLenRatio float64, minDensity float64) string {
+	pts := trip.Shape.Points
+
+	// up to 3 pairwise distinct points
+	distinct := make([][2]float64, 0, 3)
+	for i := range pts {
+		c := pointCoords(pts[i])
+		isNew := true
+		for _, d := range distinct {
+			if coordsEqual(c, d, eps) {
+				isNew = false
+				break
+			}
+		}
+		if isNew {
+			distinct = append(distinct, c)
+		}
+		if len(distinct) == 3 {
+			break
+		}
+	}
+
+	if len(distinct) < 2 {
+		return "few-points"
+	}
+
+	if len(distinct) == 3 && onStops(trip, collinearTol, distMode) {
+		return "collinear"
+	}
+
+	if shapeLength(trip.Shape, distMode) < minLenRatio*stopSpread(trip, distMode) {
+		return "short"
+	}
+
+	if d, ok := pointDensity(trip.Shape, distMode); ok && minDensity > 0 && d < minDensity {
+		return "sparse"
+	}
+
+	return ""
+}
+
+// true if every point of the trip's shape is within tol meters of one of the
+// trip's stops
+func onStops(trip *gtfs.Trip, tol float64, distMode string) bool {
+	for _, p := range trip.Shape.Points {
+		near := false
+		for _, st := range trip.StopTimes {
+			if geoDist(p.Lat, p.Lon, st.Stop.Lat, st.Stop.Lon, distMode) <= tol {
+				near = true
+				break
+			}
+		}
+		if !near {
+			return false
+		}
+	}
+	return true
+}
+
+// ratio of the shape length to the straight-line distance between the first
+// and the last stop, not defined for trips whose terminal stops are closer
+// than minSpan meters (e.g. loop routes)
+func detourFactor(trip *gtfs.Trip, distMode string, minSpan float64) (float64, bool) {
+	if len(trip.StopTimes) < 2 {
+		return 0, false
+	}
+
+	first := trip.StopTimes[0].Stop
+	last := trip.StopTimes[len(trip.StopTimes)-1].Stop
+	span := geoDist(first.Lat, first.Lon, last.Lat, last.Lon, distMode)
+
+	if span < minSpan {
+		return 0, false
+	}
+
+	return shapeLength(trip.Shape, distMode) / span, true
+}
+
+// Straight-line distance between the trip's first and last stop, and whether
+// a shape of length shpLen can not connect them: even with both terminal
+// stops maxDist meters off the shape's ends, the shape is shorter than the
+// remaining span.
+func impossibleShape(trip *gtfs.Trip, shpLen float64, maxDist float64, distMode string) (float64, bool) {
+	if len(trip.StopTimes) < 2 {
+		return 0, false
+	}
+
+	first := trip.StopTimes[0].Stop
+	last := trip.StopTimes[len(trip.StopTimes)-1].Stop
+	span := geoDist(first.Lat, first.Lon, last.Lat, last.Lon, distMode)
+
+	return span, shpLen < span-2*maxDist
+}
+
+// true if the shape's points are ordered by strictly increasing shape_pt_sequence
+func hasOrderedSeq(shp *gtfs.Shape) bool {
+	for i := 1; i < len(shp.Points); i++ {
+		if shp.Points[i].Sequence <= shp.Points[i-1].Sequence {
+			return false
+		}
+	}
+	return true
+}
+
+// number of shape points within eps meters of their predecessor
+func dupPoints(shp *gtfs.Shape, eps float64) int {
+	n := 0
+	for i := 1; i < len(shp.Points); i++ {
+		if coordsEqual(pointCoords(shp.Points[i-1]), pointCoords(shp.Points[i]), eps) {
+			n += 1
+		}
+	}
+	return n
+}
+
+// removes shape points within eps meters of the previously kept point,
+// returns the number of removed points
+func dedupPoints(shp *gtfs.Shape, eps float64) int {
+	if len(shp.Points) == 0 {
+		return 0
+	}
+
+	pts := shp.Points[:1]
+	for _, p := range shp.Points[1:] {
+		last := pts[len(pts)-1]
+		if !coordsEqual(pointCoords(last), pointCoords(p), eps) {
+			pts = append(pts, p)
+		}
+	}
+
+	n := len(shp.Points) - len(pts)
+	shp.Points = pts
+	return n
+}
+
+type StopSnap struct {
+	// distance in meters from the stop to the shape
+	Dist float64
+	// index i of the nearest shape segment (i-1, i)
+	Seg int
+	// position of the stop's foot point on that segment, in [0, 1]
+	T float64
+	// position of the foot point along the shape, in meters
+	Pos float64
+	// Dist split into the offsets across and along the segment, Along is only
+	// non-zero for stops beyond the ends of the segment
+	Cross float64
+	Along float64
+}
+
+// Snaps each of the trip's stops to the trip's shape. If both the stop times
+// and the shape points carry shape_dist_traveled, each stop is measured
+// against the shape segment at its declared position, otherwise against the
+// nearest segment of the whole shape.
+func check_shape(trip *gtfs.Trip, feed *gtfsparser.Feed, distMode string, shpCache *shapeCache) []StopSnap {
+	shp := trip.Shape
+	snaps := make([]StopSnap, 0, len(trip.StopTimes))
+
+	proj := shpCache.projected(shp)
+	cum := shpCache.cumLengths(shp)
+
+	useDists := hasDistTraveled(shp)
+
+	// stops are projected on the same side of the antimeridian as the shape
+	refLon := 0.0
+	if len(shp.Points) > 0 {
+		refLon = float64(shp.Points[0].Lon)
+	}
+
+	for _, s := range trip.StopTimes {
+		x, y := project(float64(s.Stop.Lat), unwrapLon(float64(s.Stop.Lon), refLon), distMode)
+
+		var segs []int
+
+		if useDists && s.HasDistanceTraveled() {
+			if i := segmentAtDist(shp, s.Shape_dist_traveled); i > 0 {
+				segs = []int{i}
+			}
+		}
+
+		if segs == nil {
+			if len(proj)-1 >= GRID_MIN_SEGS {
+				// candidates are chosen by their uncorrected distance in the
+				// projected plane, the slack keeps the nearest segment in
+				// meters among them
+				g := shpCache.grid(shp)
+				segs = g.candidates(proj, x, y, g.slack(y, distMode))
+			} else {
+				for i := 1; i < len(proj); i++ {
+					segs = append(segs, i)
+				}
+			}
+		}
+
+		snap := StopSnap{Dist: math.Inf(1), Seg: -1}
+
+		for _, i := range segs {
+			var curdist float64
+			if distMode == "haversine" {
+				a, b := shp.Points[i-1], shp.Points[i]
+				curdist = haversinePerpDist(float64(s.Stop.Lat), float64(s.Stop.Lon), float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon))
+			} else if distMode == "enu" {
+				a, b := shp.Points[i-1], shp.Points[i]
+				curdist = enuPerpDist(float64(s.Stop.Lat), float64(s.Stop.Lon), float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon))
+			} else {
+				curdist = projPerpDist(x, y, proj[i-1][0], proj[i-1][1], proj[i][0], proj[i][1], distMode)
+			}
+			if curdist < snap.Dist || (curdist == snap.Dist && i < snap.Seg) {
+				snap.Dist = curdist
+				snap.Seg = i
+			}
+		}
+
+		if snap.Seg > 0 {
+			i := snap.Seg
+			t := lineParam(x, y, proj[i-1][0], proj[i-1][1], proj[i][0], proj[i][1])
+			snap.T = math.Max(0, math.Min(1, t))
+			snap.Pos = cum[i-1] + snap.T*(cum[i]-cum[i-1])
+			snap.Along = math.Min(snap.Dist, math.Abs(t-snap.T)*(cum[i]-cum[i-1]))
+			snap.Cross = math.Sqrt(math.Max(0, snap.Dist*snap.Dist-snap.Along*snap.Along))
+		}
+
+		snaps = append(snaps, snap)
+	}
+
+	return snaps
+}
+
+// distance in meters from the stop to the nearest segment of the polyline
+// pts, proj are the projected pts and g an optional grid over them
+func nearestSegDist(st *gtfs.Stop, pts gtfs.ShapePoints, proj [][]float64, g *segGrid, distMode string) float64 {
+	x, y := project(float64(st.Lat), unwrapLon(float64(st.Lon), float64(pts[0].Lon)), distMode)
+
+	var segs []int
+	if g != nil && len(proj)-1 >= GRID_MIN_SEGS {
+		segs = g.candidates(proj, x, y, g.slack(y, distMode))
+	} else {
+		for i := 1; i < len(proj); i++ {
+			segs = append(segs, i)
+		}
+	}
+
+	best := math.Inf(1)
+	for _, i := range segs {
+		var d float64
+		if distMode == "haversine" {
+			a, b := pts[i-1], pts[i]
+			d = haversinePerpDist(float64(st.Lat), float64(st.Lon), float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon))
+		} else if distMode == "enu" {
+			a, b := pts[i-1], pts[i]
+			d = enuPerpDist(float64(st.Lat), float64(st.Lon), float64(a.Lat), float64(a.Lon), float64(b.Lat), float64(b.Lon))
+		} else {
+			d = projPerpDist(x, y, proj[i-1][0], proj[i-1][1], proj[i][0], proj[i][1], distMode)
+		}
+		best = math.Min(best, d)
+	}
+
+	return best
+}
+
+// true if the stop is farther than maxDists[i] meters from each shape shps[i]
+func isOrphanStop(st *gtfs.Stop, shps []*gtfs.Shape, maxDists []float64, distMode string, shpCache *shapeCache) bool {
+	for i, shp := range shps {
+		if len(shp.Points) < 2 {
+			continue
+		}
+		maxDist := maxDists[i]
+
+		x, y := project(float64(st.Lat), unwrapLon(float64(st.Lon), float64(shp.Points[0].Lon)), distMode)
+		g := shpCache.grid(shp)
+
+		slackDist := maxDist * projScale(st.Lat, distMode) * g.slack(y, distMode)
+		if x < g.minX-slackDist || y < g.minY-slackDist || x > g.minX+float64(g.nx)*g.cell+slackDist || y > g.minY+float64(g.ny)*g.cell+slackDist {
+			continue
+		}
+
+		if nearestSegDist(st, shp.Points, shpCache.projected(shp), g, distMode) <= maxDist {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the shape's points kept by Douglas-Peucker simplification with a tolerance
+// of eps meters, together with their projections proj
+func simplifiedPoints(shp *gtfs.Shape, proj [][]float64, eps float64, distMode string) (gtfs.ShapePoints, [][]float64) {
+	if len(shp.Points) == 0 {
+		return shp.Points, proj
+	}
+
+	kept := douglasPeucker(proj, eps*projScale(shp.Points[0].Lat, distMode))
+
+	pts := make(gtfs.ShapePoints, len(kept))
+	simpProj := make([][]float64, len(kept))
+	for i, k := range kept {
+		pts[i] = shp.Points[k]
+		simpProj[i] = proj[k]
+	}
+
+	return pts, simpProj
+}
+
+// Indices of the points kept by Douglas-Peucker simplification of the
+// projected points with tolerance eps, in projected units. The first and last
+// point are always kept.
+func douglasPeucker(proj [][]float64, eps float64) []int {
+	if len(proj) < 3 {
+		ret := make([]int, len(proj))
+		for i := range ret {
+			ret[i] = i
+		}
+		return ret
+	}
+
+	keep := make([]bool, len(proj))
+	keep[0], keep[len(proj)-1] = true, true
+
+	stack := [][2]int{{0, len(proj) - 1}}
+	for len(stack) > 0 {
+		a, b := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		far, farDist := -1, eps
+		for i := a + 1; i < b; i++ {
+			if d := perpDist(proj[i][0], proj[i][1], proj[a][0], proj[a][1], proj[b][0], proj[b][1]); d > farDist {
+				far, farDist = i, d
+			}
+		}
+
+		if far >= 0 {
+			keep[far] = true
+			stack = append(stack, [2]int{a, far}, [2]int{far, b})
+		}
+	}
+
+	ret := make([]int, 0)
+	for i, k := range keep {
+		if k {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// number of distinct positions along the shape the stops snap to, positions
+// at most eps meters apart are the same
+func distinctFootPoints(snaps []StopSnap, eps float64) int {
+	pos := make([]float64, 0, len(snaps))
+	for _, s := range snaps {
+		if s.Seg > 0 {
+			pos = append(pos, s.Pos)
+		}
+	}
+	sort.Float64s(pos)
+
+	n := 0
+	for i := range pos {
+		if i == 0 || pos[i]-pos[i-1] > eps {
+			n += 1
+		}
+	}
+	return n
+}
+
+// stops may snap up to this many meters behind their predecessor along the
+// shape before they count as out of order
+var OUT_OF_ORDER_EPS float64 = 1
+
+// index of the first stop that snaps to a position along the shape before
+// that of the previous stop, or -1 if the positions are non-decreasing
+func outOfOrderStop(snaps []StopSnap) int {
+	for i := 1; i < len(snaps); i++ {
+		if snaps[i].Seg > 0 && snaps[i-1].Seg > 0 && snaps[i].Pos < snaps[i-1].Pos-OUT_OF_ORDER_EPS {
+			return i
+		}
+	}
+	return -1
+}
+
+// Lengths in meters of the shape before the first and after the last stop's
+// foot point, e.g. depot access legs.
+func shapeTails(snaps []StopSnap, shpLen float64) (float64, float64) {
+	if len(snaps) < 2 || snaps[0].Seg <= 0 || snaps[len(snaps)-1].Seg <= 0 {
+		return 0, 0
+	}
+
+	return snaps[0].Pos, math.Max(0, shpLen-snaps[len(snaps)-1].Pos)
+}
+
+// Fraction of the shape's points outside the bounding box of the trip's
+// stops, expanded by pad meters on every side. A shape belonging to another
+// trip typically leaves it by far. False for fewer than 2 stops and for
+// shapes crossing the antimeridian.
+func outsideStopBBox(trip *gtfs.Trip, pad float64) (float64, bool) {
+	if len(trip.StopTimes) < 2 || len(trip.Shape.Points) == 0 || crossesAntimeridian(trip.Shape) {
+		return 0, false
+	}
+
+	bb := BBox{}
+	for _, st := range trip.StopTimes {
+		bb.add(st.Stop.Lat, st.Stop.Lon)
+	}
+	if bb.Points == 0 {
+		return 0, false
+	}
+
+	// a degree of longitude is shortest at the latitude farthest from the
+	// equator, pad there to cover the whole box
+	dLat := pad / EARTH_RADIUS * 180 / math.Pi
+	dLon := 180.0
+	if c := math.Cos(math.Max(math.Abs(bb.MinLat), math.Abs(bb.MaxLat)) * math.Pi / 180); c > 0 {
+		dLon = math.Min(180, dLat/c)
+	}
+
+	outside := 0
+	for _, p := range trip.Shape.Points {
+		lat, lon := float64(p.Lat), float64(p.Lon)
+		if lat < bb.MinLat-dLat || lat > bb.MaxLat+dLat || lon < bb.MinLon-dLon || lon > bb.MaxLon+dLon {
+			outside += 1
+		}
+	}
+
+	return float64(outside) / float64(len(trip.Shape.Points)), true
+}
+
+// Gaps in meters by which the shape ends short of the first and the last
+// stop: a terminal stop snapping to the shape's very end farther than maxDist
+// away lies beyond it. 0 if the shape reaches the stop.
+func terminalGaps(snaps []StopSnap, shpLen float64, maxDist float64) (float64, float64) {
+	if len(snaps) < 2 {
+		return 0, 0
+	}
+
+	start, end := 0.0, 0.0
+	if first := snaps[0]; first.Seg > 0 && first.Pos <= 0 && first.Dist > maxDist {
+		start = first.Dist
+	}
+	if last := snaps[len(snaps)-1]; last.Seg > 0 && last.Pos >= shpLen && last.Dist > maxDist {
+		end = last.Dist
+	}
+
+	return start, end
+}
+
+// Index of the first stop whose direction from the previous stop differs by
+// more than maxDiff degrees from the local direction of the shape at the
+// snapped positions of both stops, and that difference. Stop pairs closer
+// than minSpan meters are skipped, as their direction is unreliable. Both
+// projections are conformal, so directions are compared in the projected
+// plane. Returns -1 if all stop pairs agree with the shape.
+func bearingViolation(trip *gtfs.Trip, snaps []StopSnap, proj [][]float64, distMode string, maxDiff float64, minSpan float64) (int, float64) {
+	refLon := float64(trip.Shape.Points[0].Lon)
+
+	for i := 1; i < len(snaps) && i < len(trip.StopTimes); i++ {
+		a, b := snaps[i-1], snaps[i]
+		if a.Seg <= 0 || b.Seg <= 0 {
+			continue
+		}
+
+		sa, sb := trip.StopTimes[i-1].Stop, trip.StopTimes[i].Stop
+		if geoDist(sa.Lat, sa.Lon, sb.Lat, sb.Lon, distMode) < minSpan {
+			continue
+		}
+
+		ax, ay := project(float64(sa.Lat), unwrapLon(float64(sa.Lon), refLon), distMode)
+		bx, by := project(float64(sb.Lat), unwrapLon(float64(sb.Lon), refLon), distMode)
+		stopDir := math.Atan2(bx-ax, by-ay)
+
+		diff := math.Inf(1)
+		for _, seg := range []int{a.Seg, b.Seg} {
+			p, q := proj[seg-1], proj[seg]
+			if p[0] == q[0] && p[1] == q[1] {
+				diff = 0
+				break
+			}
+			diff = math.Min(diff, angleDiff(stopDir, math.Atan2(q[0]-p[0], q[1]-p[1]))/DEG_TO_RAD)
+		}
+
+		if diff > maxDiff {
+			return i, diff
+		}
+	}
+
+	return -1, 0
+}
+
+// absolute difference of two angles in radians, in [0, pi]
+func angleDiff(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 2*math.Pi)
+	if d > math.Pi {
+		d = 2*math.Pi - d
+	}
+	return d
+}
+
+// Fraction of the shape's length that lies within maxDist of at least one of
+// the trip's stops, and false if the shape has no length. For each segment,
+// the parts inside the circles around the stops are merged, the circles are
+// scaled to projected units at the latitude of their stop. Stops are looked
+// up in a grid with cells of the largest radius, in the cells the segment
+// passes through and their neighbors.
+func coveredFraction(trip *gtfs.Trip, proj [][]float64, cum []float64, maxDist float64, distMode string) (float64, bool) {
+	total := cum[len(cum)-1]
+	if total <= 0 || len(trip.StopTimes) == 0 {
+		return 0, false
+	}
+
+	refLon := float64(trip.Shape.Points[0].Lon)
+
+	stops := make([][3]float64, len(trip.StopTimes))
+	cell := 1.0
+	for i, st := range trip.StopTimes {
+		x, y := project(float64(st.Stop.Lat), unwrapLon(float64(st.Stop.Lon), refLon), distMode)
+		r := maxDist * projScale(st.Stop.Lat, distMode)
+		stops[i] = [3]float64{x, y, r}
+		cell = math.Max(cell, r)
+	}
+
+	grid := make(map[[2]int][]int)
+	for i, st := range stops {
+		c := [2]int{int(math.Floor(st[0] / cell)), int(math.Floor(st[1] / cell))}
+		grid[c] = append(grid[c], i)
+	}
+
+	// segment index the stop was last tested for
+	tested := make([]int, len(stops))
+
+	covered := 0.0
+	for i := 1; i < len(proj); i++ {
+		a, b := proj[i-1], proj[i]
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		l := dx*dx + dy*dy
+		if l == 0 || cum[i] == cum[i-1] {
+			continue
+		}
+
+		// intervals of the segment parameter t inside any circle
+		in := make([][2]float64, 0)
+
+		// a stop within its radius of the segment lies at most one cell away
+		// from a cell the segment passes through
+		walkCells(a, b, cell, func(px, py int) {
+			for cx := px - 1; cx <= px+1; cx++ {
+				for cy := py - 1; cy <= py+1; cy++ {
+					for _, j := range grid[[2]int{cx, cy}] {
+						if tested[j] == i {
+							continue
+						}
+						tested[j] = i
+
+						// solve |a + t * (b - a) - s| = r for t
+						fx, fy := a[0]-stops[j][0], a[1]-stops[j][1]
+						hb := fx*dx + fy*dy
+						disc := hb*hb - l*(fx*fx+fy*fy-stops[j][2]*stops[j][2])
+						if disc <= 0 {
+							continue
+						}
+						t0 := math.Max(0, (-hb-math.Sqrt(disc))/l)
+						t1 := math.Min(1, (-hb+math.Sqrt(disc))/l)
+						if t0 < t1 {
+							in = append(in, [2]float64{t0, t1})
+						}
+					}
+				}
+			}
+		})
+
+		sort.Slice(in, func(p, q int) bool { return in[p][0] < in[q][0] })
+
+		frac, end := 0.0, 0.0
+		for _, iv := range in {
+			if iv[1] <= end {
+				continue
+			}
+			frac += iv[1] - math.Max(iv[0], end)
+			end = iv[1]
+		}
+
+		covered += frac * (cum[i] - cum[i-1])
+	}
+
+	return covered / total, true
+}
+
+// true if passengers can neither board nor alight, i.e. both pickup_type and
+// drop_off_type are 1 ("no pickup" / "no drop off available"). Stops that
+// require phoning the agency or coordinating with the driver (types 2 and 3)
+// still count as stopping.
+func isNonStop(st *gtfs.StopTime) bool {
+	return st.Pickup_type == 1 && st.Drop_off_type == 1
+}
+
+// copy of the trip without its non-stopping stop times, and the number of
+// stop times removed
+func withoutNonStops(trip *gtfs.Trip) (*gtfs.Trip, int) {
+	ret := *trip
+	ret.StopTimes = make(gtfs.StopTimes, 0, len(trip.StopTimes))
+
+	for i := range trip.StopTimes {
+		if !isNonStop(&trip.StopTimes[i]) {
+			ret.StopTimes = append(ret.StopTimes, trip.StopTimes[i])
+		}
+	}
+
+	return &ret, len(trip.StopTimes) - len(ret.StopTimes)
+}
+
+// true if the stop's coordinates are unset, i.e. exactly 0,0 or not a number
+func isNullStop(st *gtfs.Stop) bool {
+	return (st.Lat == 0 && st.Lon == 0) || st.Lat != st.Lat || st.Lon != st.Lon
+}
+
+// Sets the coordinates of stops without any, typically platforms, to those of
+// their closest ancestor station with coordinates. Returns the number of
+// stops changed.
+func inheritParentCoords(stops map[string]*gtfs.Stop) int {
+	n := 0
+	for _, st := range stops {
+		if !isNullStop(st) {
+			continue
+		}
+		// bounded, in case of a cycle of parent stations
+		p := st.Parent_station
+		for i := 0; p != nil && isNullStop(p) && i < 3; i++ {
+			p = p.Parent_station
+		}
+		if p != nil && !isNullStop(p) {
+			st.Lat, st.Lon = p.Lat, p.Lon
+			n += 1
+		}
+	}
+	return n
+}
+
+// copy of the trip without its stop times at stops with unset coordinates,
+// and the number of stop times removed
+func withoutNullStops(trip *gtfs.Trip) (*gtfs.Trip, int) {
+	ret := *trip
+	ret.StopTimes = make(gtfs.StopTimes, 0, len(trip.StopTimes))
+
+	for i := range trip.StopTimes {
+		if !isNullStop(trip.StopTimes[i].Stop) {
+			ret.StopTimes = append(ret.StopTimes, trip.StopTimes[i])
+		}
+	}
+
+	return &ret, len(trip.StopTimes) - len(ret.StopTimes)
+}
+
+func toTime(d gtfs.Date) time.Time {
+	return time.Date(int(d.Year), time.Month(d.Month), int(d.Day), 12, 0, 0, 0, time.UTC)
+}
+
+func toDate(t time.Time) gtfs.Date {
+	return gtfs.Date{Day: int8(t.Day()), Month: int8(t.Month()), Year: int16(t.Year())}
+}
+
+// number of days the service is active on, over its calendar span and all of
+// its calendar_dates exceptions
+func serviceDays(svc *gtfs.Service) int {
+	if svc == nil {
+		return 0
+	}
+
+	start := toTime(svc.Start_date)
+	end := toTime(svc.End_date)
+
+	for d := range svc.Exceptions {
+		if t := toTime(d); svc.Start_date.Year == 0 || t.Before(start) {
+			start = t
+		}
+		if t := toTime(d); svc.End_date.Year == 0 || t.After(end) {
+			end = t
+		}
+	}
+
+	days := 0
+	for t := start; !t.After(end); t = t.AddDate(0, 0, 1) {
+		if svc.IsActiveOn(toDate(t)) {
+			days += 1
+		}
+	}
+
+	return days
+}
+
+// number of daily departures of a trip, taking frequencies.txt into account
+func tripsPerDay(trip *gtfs.Trip) float64 {
+	if len(trip.Frequencies) == 0 {
+		return 1
+	}
+
+	n := 0.0
+	for _, f := range trip.Frequencies {
+		if f.Headway_secs > 0 {
+			n += math.Max(1, float64(f.End_time.SecondsSinceMidnight()-f.Start_time.SecondsSinceMidnight())/float64(f.Headway_secs))
+		}
+	}
+
+	return n
+}
+
+type snapKey struct {
+	shp   *gtfs.Shape
+	stops string
+}
+
+// key identifying trips with identical shape and stop pattern, which will
+// have identical stop snaps
+func tripSnapKey(trip *gtfs.Trip) snapKey {
+	var b strings.Builder
+	for i := range trip.StopTimes {
+		st := &trip.StopTimes[i]
+		b.WriteString(st.Stop.Id)
+		b.WriteByte(0)
+		if st.HasDistanceTraveled() {
+			b.WriteString(strconv.FormatFloat(float64(st.Shape_dist_traveled), 'g', -1, 32))
+		}
+		b.WriteByte(0)
+	}
+	return snapKey{trip.Shape, b.String()}
+}
+
+func snapDists(snaps []StopSnap) []float64 {
+	ret := make([]float64, len(snaps))
+	for i, s := range snaps {
+		ret[i] = s.Dist
+	}
+	return ret
+}
+
+// true if the trip's first stop lies in the last third of the shape and the
+// last stop in the first third, i.e. the shape runs in the opposite direction
+func isReversed(trip *gtfs.Trip, snaps []StopSnap, shpLen float64, minSpan float64, distMode string) bool {
+	if len(snaps) < 2 || shpLen == 0 {
+		return false
+	}
+
+	first := trip.StopTimes[0].Stop
+	last := trip.StopTimes[len(trip.StopTimes)-1].Stop
+
+	// loop routes may legitimately snap both terminals to either shape end
+	if geoDist(first.Lat, first.Lon, last.Lat, last.Lon, distMode) < minSpan {
+		return false
+	}
+
+	return snaps[0].Pos > shpLen*2/3 && snaps[len(snaps)-1].Pos < shpLen/3
+}
+
+// true if every shape point has a non-decreasing shape_dist_traveled
+func hasDistTraveled(shp *gtfs.Shape) bool {
+	if len(shp.Points) < 2 {
+		return false
+	}
+
+	for i := range shp.Points {
+		if !shp.Points[i].HasDistanceTraveled() {
+			return false
+		}
+		if i > 0 && shp.Points[i].Dist_traveled < shp.Points[i-1].Dist_traveled {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Smallest and largest shape_dist_traveled of the shape's points, whether
+// they decrease anywhere along the shape, and false if not all points carry
+// a value. Points are expected in shape_pt_sequence order.
+func shapeDistRange(shp *gtfs.Shape) (float32, float32, bool, bool) {
+	if len(shp.Points) == 0 {
+		return 0, 0, false, false
+	}
+
+	min, max := shp.Points[0].Dist_traveled, shp.Points[0].Dist_traveled
+	decreasing := false
+	for i := range shp.Points {
+		if !shp.Points[i].HasDistanceTraveled() {
+			return 0, 0, false, false
+		}
+		d := shp.Points[i].Dist_traveled
+		if i > 0 && d < shp.Points[i-1].Dist_traveled {
+			decreasing = true
+		}
+		min = float32(math.Min(float64(min), float64(d)))
+		max = float32(math.Max(float64(max), float64(d)))
+	}
+
+	return min, max, decreasing, true
+}
+
+// Number of the trip's stop times whose shape_dist_traveled lies outside
+// [min, max], and whether the values decrease from one stop to the next.
+// Stop times without a value are skipped.
+func checkStopDists(trip *gtfs.Trip, min, max float32) (int, bool) {
+	outside := 0
+	decreasing := false
+	var prev float32
+	hasPrev := false
+
+	for i := range trip.StopTimes {
+		st := &trip.StopTimes[i]
+		if !st.HasDistanceTraveled() {
+			continue
+		}
+		if st.Shape_dist_traveled < min || st.Shape_dist_traveled > max {
+			outside += 1
+		}
+		if hasPrev && st.Shape_dist_traveled < prev {
+			decreasing = true
+		}
+		prev, hasPrev = st.Shape_dist_traveled, true
+	}
+
+	return outside, decreasing
+}
+
+// index i of the shape segment (i-1, i) containing the position d along the
+// shape, or -1 if d lies outside the shape
+func segmentAtDist(shp *gtfs.Shape, d float32) int {
+	for i := 1; i < len(shp.Points); i++ {
+		if shp.Points[i-1].Dist_traveled <= d && d <= shp.Points[i].Dist_traveled {
+			return i
+		}
+	}
+	return -1
+}
+
+// Max distance of each of the trip's stops: frac times the mean distance to
+// its neighboring stops, at least floor and at most cap meters.
+func spacingMaxDists(trip *gtfs.Trip, distMode string, frac float64, floor float64, cap float64) []float64 {
+	sts := trip.StopTimes
+	gaps := make([]float64, len(sts))
+	for i := 1; i < len(sts); i++ {
+		gaps[i] = geoDist(sts[i-1].Stop.Lat, sts[i-1].Stop.Lon, sts[i].Stop.Lat, sts[i].Stop.Lon, distMode)
+	}
+
+	ret := make([]float64, len(sts))
+	for i := range sts {
+		spacing, n := 0.0, 0
+		if i > 0 {
+			spacing += gaps[i]
+			n += 1
+		}
+		if i < len(sts)-1 {
+			spacing += gaps[i+1]
+			n += 1
+		}
+		if n > 0 {
+			spacing /= float64(n)
+		}
+		ret[i] = math.Max(floor, math.Min(cap, frac*spacing))
+	}
+	return ret
+}
+
+// index and value of the largest distance, or -1 and -Inf if there are none
+func worstStop(dists []float64) (int, float64) {
+	idx := -1
+	worst := math.Inf(-1)
+	for i, d := range dists {
+		if d > worst {
+			idx = i
+			worst = d
+		}
+	}
+	return idx, worst
+}
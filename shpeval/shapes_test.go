@@ -0,0 +1,95 @@
+// Copyright 2020, University of Freiburg
+// Chair of Algorithms and Data Strcutures
+// Authors: Patrick Brosi <brosi@informatik.uni-freiburg.de>
+
+package shpeval
+
+import (
+	gtfs "github.com/patrickbr/gtfsparser/gtfs"
+	"math"
+	"testing"
+)
+
+// a trip with stops and a shape along the parallel 48° N at the given
+// longitudes
+func parallelTrip(stopLons []float32, shapeLons []float32) *gtfs.Trip {
+	trip := &gtfs.Trip{Id: "t", Shape: &gtfs.Shape{Id: "s"}}
+	for i, lon := range stopLons {
+		trip.StopTimes = append(trip.StopTimes, gtfs.StopTime{Stop: &gtfs.Stop{Id: string(rune('a' + i)), Lat: 48, Lon: lon}, Sequence: i + 1})
+	}
+	for i, lon := range shapeLons {
+		trip.Shape.Points = append(trip.Shape.Points, gtfs.ShapePoint{Lat: 48, Lon: lon, Sequence: i + 1})
+	}
+	return trip
+}
+
+func TestDegenerateCollinear(t *testing.T) {
+	tests := []struct {
+		name      string
+		stopLons  []float32
+		shapeLons []float32
+		want      string
+	}{
+		{"placeholder through the stops", []float32{7.8, 7.85, 7.9}, []float32{7.8, 7.85, 7.9}, "collinear"},
+		{"two distinct points", []float32{7.8, 7.85, 7.9}, []float32{7.8, 7.9}, ""},
+		{"straight line with points between the stops", []float32{7.8, 7.85, 7.9}, []float32{7.8, 7.82, 7.84, 7.86, 7.88, 7.9}, ""},
+		{"single distinct point", []float32{7.8, 7.85}, []float32{7.8, 7.8}, "few-points"},
+	}
+
+	for _, tt := range tests {
+		for _, distMode := range []string{"webmerc", "haversine", "enu"} {
+			if got := degenerateReason(parallelTrip(tt.stopLons, tt.shapeLons), distMode, 0.5, 1, 0.5, 0); got != tt.want {
+				t.Errorf("%s (%s): got '%s', want '%s'", tt.name, distMode, got, tt.want)
+			}
+		}
+	}
+}
+
+// Segments of the shape span several grid cells, the stop in the middle lies
+// on a segment between two shape points.
+func TestCoveredFraction(t *testing.T) {
+	shapeLons := make([]float32, 0)
+	for lon := float32(7.8); lon < 7.905; lon += 0.01 {
+		shapeLons = append(shapeLons, lon)
+	}
+	trip := parallelTrip([]float32{7.8, 7.855, 7.9}, shapeLons)
+
+	for _, distMode := range []string{"webmerc", "haversine", "enu"} {
+		c := newShapeCache(distMode)
+		cum := c.cumLengths(trip.Shape)
+		got, ok := coveredFraction(trip, c.projected(trip.Shape), cum, 250, distMode)
+
+		// half circles at both ends and a full one in the middle
+		want := 1000 / cum[len(cum)-1]
+		if !ok || math.Abs(got-want) > 0.01*want {
+			t.Errorf("%s: got a covered fraction of %.4f (%v), want %.4f", distMode, got, ok, want)
+		}
+	}
+}
+
+// The stop at 50° N is nearer to the shape's leg at 60° N in meters, but
+// nearer to the leg at 39.9° N in web mercator units, which grow with the
+// latitude. The grid must still find the nearest leg in meters.
+func TestNearestSegDistAcrossLatitudes(t *testing.T) {
+	pts := make(gtfs.ShapePoints, 0)
+	for lon := -20; lon <= 20; lon++ {
+		pts = append(pts, gtfs.ShapePoint{Lat: 60, Lon: float32(lon)})
+	}
+	for lon := 20; lon >= -20; lon-- {
+		pts = append(pts, gtfs.ShapePoint{Lat: 39.9, Lon: float32(lon)})
+	}
+	st := &gtfs.Stop{Id: "s", Lat: 50, Lon: 0.5}
+
+	for _, distMode := range []string{"webmerc", "haversine", "enu"} {
+		proj := make([][]float64, len(pts))
+		for i, p := range pts {
+			x, y := project(float64(p.Lat), float64(p.Lon), distMode)
+			proj[i] = []float64{x, y}
+		}
+
+		want := nearestSegDist(st, pts, proj, nil, distMode)
+		if got := nearestSegDist(st, pts, proj, newSegGrid(proj), distMode); got != want {
+			t.Errorf("%s: got %.2f m with the grid, want %.2f m", distMode, got, want)
+		}
+	}
+}